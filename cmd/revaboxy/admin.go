@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// serveAdmin serves the admin endpoints, like metrics, on a separate listener from the proxy
+func serveAdmin(addr string, mux *http.ServeMux) {
+	log.Printf("admin endpoints listen to %s", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
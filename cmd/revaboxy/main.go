@@ -1,46 +1,46 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"regexp"
-	"strconv"
-	"strings"
+	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/lindell/revaboxy/internal/time"
-
+	"github.com/lindell/revaboxy/internal/config"
 	"github.com/lindell/revaboxy/pkg/revaboxy"
 )
 
 func main() {
-	host := envOrDefault("HOST", "")
-	port := envOrDefault("PORT", "80")
-	addr := host + ":" + port
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := report(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	configFile := flag.String("config", "", "path to a YAML or JSON configuration file")
+	flag.Parse()
 
-	versions, err := versionsFromEnvVars()
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Configuring settings
-	settings := []revaboxy.Setting{}
-	settings = append(settings, revaboxy.WithLogger(log.New(os.Stdout, "", log.Ldate|log.Ltime|log.LUTC)))
-	if headerName, ok := syscall.Getenv("HEADER_NAME"); ok {
-		settings = append(settings, revaboxy.WithHeaderName(headerName))
-	}
-	if cookieName, ok := syscall.Getenv("COOKIE_NAME"); ok {
-		settings = append(settings, revaboxy.WithCookieName(cookieName))
+	versions, settings, err := cfg.Build()
+	if err != nil {
+		log.Fatal(err)
 	}
-	if cookieExpiryStr, ok := syscall.Getenv("COOKIE_EXPIRY"); ok {
-		cookieExpiry, err := time.ParseDuration(cookieExpiryStr)
-		if err != nil {
-			log.Fatal("could not parse cookie expiry", err)
-		}
-		settings = append(settings, revaboxy.WithCookieExpiry(cookieExpiry))
+	settings = append(settings, revaboxy.WithLogger(log.New(os.Stdout, "", log.Ldate|log.Ltime|log.LUTC)))
+
+	adminMux := http.NewServeMux()
+	if cfg.AdminPort != "" {
+		metrics := revaboxy.NewPrometheusMetrics()
+		settings = append(settings, revaboxy.WithMetrics(metrics))
+		adminMux.Handle("/metrics", metrics)
 	}
 
 	proxy, err := revaboxy.New(
@@ -51,49 +51,63 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Printf("listen to %s", addr)
-	err = http.ListenAndServe(host+":"+port, proxy)
-	if err != nil {
-		log.Fatal(err)
+	adminMux.Handle("/health", proxy.HealthHandler())
+	adminMux.Handle("/status", proxy.StatusHandler())
+	adminMux.Handle("/report", proxy.ReportHandler())
+
+	go watchConfig(*configFile, time.Duration(cfg.ConfigReloadInterval), proxy)
+	if cfg.AdminPort != "" {
+		go serveAdmin(cfg.AdminAddr(), adminMux)
 	}
-}
 
-var urlRegexp = regexp.MustCompile("^VERSION_(.*)_URL$")
-
-func versionsFromEnvVars() ([]revaboxy.Version, error) {
-	var versions []revaboxy.Version
-	for _, e := range os.Environ() {
-		pair := strings.Split(e, "=")
-		envName := pair[0]
-		envVal := pair[1]
-
-		if match := urlRegexp.FindStringSubmatch(envName); match != nil {
-			name := match[1]
-			probabilityStr := os.Getenv(fmt.Sprintf("VERSION_%s_PROBABILITY", name))
-			probability, err := strconv.ParseFloat(probabilityStr, 64)
-			if err != nil {
-				return nil, fmt.Errorf(`could not parse %s probability "%s"`, name, probabilityStr)
-			}
-
-			u, err := url.Parse(envVal)
-			if err != nil {
-				return nil, fmt.Errorf(`could not parse %s url "%s"`, name, envVal)
-			}
-
-			versions = append(versions, revaboxy.Version{
-				Name:        strings.ToLower(name),
-				URL:         u,
-				Probability: probability,
-			})
-		}
+	server := &http.Server{
+		Addr:    cfg.Addr(),
+		Handler: proxy,
 	}
+	go func() {
+		log.Printf("listen to %s", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("received %s, shutting down", sig)
+
+	shutdown(server, proxy)
+}
 
-	return versions, nil
+// shutdownTimeout is how long the requests in flight are waited for before the server is shut down anyway
+const shutdownTimeout = 30 * time.Second
+
+// shutdown stops the server once the requests in flight are done, and then closes the proxy
+// so that the buffered events, the bandit checkpoint and the store are written before the process exits
+func shutdown(server *http.Server, proxy *revaboxy.Revaboxy) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("could not wait for the requests in flight: %s", err)
+	}
+	if err := proxy.Close(); err != nil {
+		log.Printf("could not close the proxy: %s", err)
+	}
 }
 
-func envOrDefault(name, def string) string {
-	if value, ok := syscall.Getenv(name); ok {
-		return value
+// loadConfig reads the config file, if any, and overrides it with the environment variables
+func loadConfig(file string) (*config.Config, error) {
+	cfg := config.Default()
+	if file != "" {
+		var err error
+		cfg, err = config.Load(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
 	}
-	return def
+	return cfg, nil
 }
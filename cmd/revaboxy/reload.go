@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lindell/revaboxy/pkg/revaboxy"
+)
+
+// reloadVersions reads the configuration again and updates the versions of the proxy and its experiments
+// Nothing is changed unless all versions are valid. Experiments can not be added or removed, and other settings are not changed
+// until the process is restarted
+func reloadVersions(file string, proxy *revaboxy.Revaboxy) {
+	cfg, err := loadConfig(file)
+	if err != nil {
+		log.Printf("could not reload the configuration: %s", err)
+		return
+	}
+	versions, experiments, err := cfg.BuildVersions()
+	if err != nil {
+		log.Printf("could not reload the configuration: %s", err)
+		return
+	}
+	if err := proxy.UpdateAllVersions(versions, experiments); err != nil {
+		log.Printf("could not update the versions: %s", err)
+		return
+	}
+	log.Printf("reloaded the versions")
+}
+
+// watchConfig reloads the versions when the process receives SIGHUP, or when the config file has been modified
+// The config file is checked for modifications every interval, an interval of 0 disables it
+func watchConfig(file string, interval time.Duration, proxy *revaboxy.Revaboxy) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var lastModified time.Time
+	if file != "" && interval > 0 {
+		tick = time.NewTicker(interval).C
+		lastModified = modTime(file)
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("received SIGHUP, reloading the versions")
+			reloadVersions(file, proxy)
+		case <-tick:
+			modified := modTime(file)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			log.Printf("the config file %s has changed, reloading the versions", file)
+			reloadVersions(file, proxy)
+		}
+	}
+}
+
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
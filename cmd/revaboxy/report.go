@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/lindell/revaboxy/pkg/revaboxy"
+)
+
+// report prints the statistical results of all experiments, read from the event file
+func report(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to a YAML or JSON configuration file, used to find the event file")
+	eventFile := flags.String("events", "", "path to the event file, overrides event_file in the configuration")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	file := *eventFile
+	if file == "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		file = cfg.EventFile
+	}
+	if file == "" {
+		return errors.New("no event file, set it with -events or event_file in the configuration")
+	}
+
+	// The rotated files are read together with the current one, the oldest first
+	files := revaboxy.EventFiles(file)
+	if len(files) == 0 {
+		return fmt.Errorf("the event file %s does not exist", file)
+	}
+	readers := make([]io.Reader, 0, len(files))
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	reports, err := revaboxy.ReportFromEvents(io.MultiReader(readers...))
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+	return printReports(out, reports)
+}
+
+// printReports prints the reports as one table per experiment
+func printReports(out io.Writer, reports []revaboxy.ExperimentReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for i, r := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		name := r.Experiment
+		if name == "" {
+			name = "main"
+		}
+		fmt.Fprintf(w, "Experiment %s\n", name)
+		fmt.Fprintln(w, "VERSION\tUSERS\tGOAL\tCONVERSIONS\tRATE\t95% CI\tLIFT\tP-VALUE\tP(BEAT DEFAULT)")
+		for _, v := range r.Versions {
+			if len(v.Goals) == 0 {
+				fmt.Fprintf(w, "%s\t%d\t-\t\t\t\t\t\t\n", v.Name, v.Users)
+				continue
+			}
+			goals := make([]string, 0, len(v.Goals))
+			for goal := range v.Goals {
+				goals = append(goals, goal)
+			}
+			sort.Strings(goals)
+			for _, goal := range goals {
+				g := v.Goals[goal]
+				fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%.2f%%\t%.2f%% - %.2f%%\t", v.Name, v.Users, goal, g.Conversions,
+					100*g.ConversionRate, 100*g.ConfidenceInterval[0], 100*g.ConfidenceInterval[1])
+				if c := g.Comparison; c != nil {
+					fmt.Fprintf(w, "%+.2f%% (%+.1f%%)\t%.4f\t%.1f%%\n", 100*c.AbsoluteLift, 100*c.RelativeLift, c.PValue, 100*c.ProbabilityToBeatDefault)
+				} else {
+					fmt.Fprint(w, "\t\t\n")
+				}
+			}
+		}
+	}
+	return w.Flush()
+}
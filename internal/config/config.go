@@ -0,0 +1,1046 @@
+// Package config contains the configuration of the revaboxy binary.
+// The configuration can be read from a YAML or JSON file, and every value can be overridden with environment variables
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	revaboxytime "github.com/lindell/revaboxy/internal/time"
+	"github.com/lindell/revaboxy/pkg/revaboxy"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the revaboxy binary
+// The environment variable that overrides a value is the yaml name in upper case
+type Config struct {
+	Host string `yaml:"host"`
+	Port string `yaml:"port"`
+
+	// The admin endpoints, like metrics, are only served if the admin port is set
+	AdminHost string `yaml:"admin_host"`
+	AdminPort string `yaml:"admin_port"`
+
+	ConfigReloadInterval Duration `yaml:"config_reload_interval"`
+
+	HeaderName          string `yaml:"header_name"`
+	SpoofedHeaderPolicy string `yaml:"spoofed_header_policy"`
+	// The header set on responses with the version used, no header is set if it is empty
+	ResponseHeader string `yaml:"response_header"`
+
+	CookieName             string   `yaml:"cookie_name"`
+	CookieExpiry           Duration `yaml:"cookie_expiry"`
+	CookieSigningKey       string   `yaml:"cookie_signing_key"`
+	CookieVerificationKeys []string `yaml:"cookie_verification_keys"`
+	CookieHTTPOnly         bool     `yaml:"cookie_http_only"`
+
+	FailoverStatusCodes []int  `yaml:"failover_status_codes"`
+	FailoverMaxBodySize int    `yaml:"failover_max_body_size"`
+	FailoverHeader      string `yaml:"failover_header"`
+
+	EjectionDuration Duration `yaml:"ejection_duration"`
+
+	// Overrides are enabled if a secret or allowed ips are set
+	OverrideQuery        string   `yaml:"override_query"`
+	OverrideHeader       string   `yaml:"override_header"`
+	OverrideSecret       string   `yaml:"override_secret"`
+	OverrideSecretHeader string   `yaml:"override_secret_header"`
+	OverrideSecretQuery  string   `yaml:"override_secret_query"`
+	OverrideAllowedIPs   []string `yaml:"override_allowed_ips"`
+
+	BucketingHeader string `yaml:"bucketing_header"`
+	BucketingCookie string `yaml:"bucketing_cookie"`
+	BucketingQuery  string `yaml:"bucketing_query"`
+	BucketingSalt   string `yaml:"bucketing_salt"`
+
+	// Hashed together with the identifiers of the users in the event log and the assignment store
+	VisitorSalt string `yaml:"visitor_salt"`
+
+	Versions []Version `yaml:"versions"`
+	// The requests that the main experiment applies to
+	Scope *Scope `yaml:"scope"`
+	// The targeting expression requests needs to match to be part of the main experiment
+	Targeting string `yaml:"targeting"`
+	// The time the main experiment is running, and the version everyone gets after it has ended
+	ExperimentStart  time.Time `yaml:"experiment_start"`
+	ExperimentEnd    time.Time `yaml:"experiment_end"`
+	ExperimentWinner string    `yaml:"experiment_winner"`
+	// The bandit mode of the main experiment is enabled if the strategy is set
+	BanditStrategy       string   `yaml:"bandit_strategy"`
+	BanditEpsilon        *float64 `yaml:"bandit_epsilon"`
+	BanditRewardHeader   string   `yaml:"bandit_reward_header"`
+	BanditUpdateInterval Duration `yaml:"bandit_update_interval"`
+	BanditCheckpointFile string   `yaml:"bandit_checkpoint_file"`
+	BanditRewardGoal     string   `yaml:"bandit_reward_goal"`
+
+	// Checks all experiments for sample ratio mismatches if enabled
+	SampleRatioCheck     bool     `yaml:"sample_ratio_check"`
+	SampleRatioThreshold float64  `yaml:"sample_ratio_threshold"`
+	SampleRatioInterval  Duration `yaml:"sample_ratio_interval"`
+	SampleRatioWindow    Duration `yaml:"sample_ratio_window"`
+	SampleRatioMinUsers  int      `yaml:"sample_ratio_min_users"`
+
+	// The file that all assignments and goals are appended to, read by the report subcommand
+	EventFile         string `yaml:"event_file"`
+	EventFileMaxSize  int    `yaml:"event_file_max_size"`
+	EventFileMaxFiles int    `yaml:"event_file_max_files"`
+	EventBufferSize   int    `yaml:"event_buffer_size"`
+
+	// Saves the assigned versions on the server if set, to "memory", "file" or "redis"
+	AssignmentStore              string `yaml:"assignment_store"`
+	AssignmentStoreSize          int    `yaml:"assignment_store_size"`
+	AssignmentStoreFile          string `yaml:"assignment_store_file"`
+	AssignmentStoreRedisAddr     string `yaml:"assignment_store_redis_addr"`
+	AssignmentStoreRedisPassword string `yaml:"assignment_store_redis_password"`
+	AssignmentStoreRedisDB       int    `yaml:"assignment_store_redis_db"`
+
+	// Goal tracking is enabled if the path, names or rules are set
+	GoalPath  string     `yaml:"goal_path"`
+	GoalNames []string   `yaml:"goal_names"`
+	GoalRules []GoalRule `yaml:"goal_rules"`
+
+	// Experiments that are run independently of the main experiment defined by the versions
+	Experiments []Experiment `yaml:"experiments"`
+
+	// The file the config was read from, and its parsed content used to find the line of fields
+	file string
+	root *yaml.Node
+	// Fields that has been set by environment variables, mapped to the name of the variable
+	envSources map[string]string
+}
+
+// Version is the configuration of one version
+type Version struct {
+	Name        string  `yaml:"name"`
+	URL         string  `yaml:"url"`
+	Probability float64 `yaml:"probability"`
+
+	// Additional urls that requests are load balanced between, together with url
+	URLs          []string `yaml:"urls"`
+	LoadBalancing string   `yaml:"load_balancing"`
+
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	Allowlist   *Allowlist   `yaml:"allowlist"`
+	Schedule    *Schedule    `yaml:"schedule"`
+
+	// The bounds of the share of new users the version gets in the bandit mode
+	MinShare float64 `yaml:"min_share"`
+	MaxShare float64 `yaml:"max_share"`
+}
+
+// Bandit is the configuration of the adaptive allocation of new users between the versions
+type Bandit struct {
+	Strategy       string   `yaml:"strategy"`
+	Epsilon        *float64 `yaml:"epsilon"`
+	RewardHeader   string   `yaml:"reward_header"`
+	UpdateInterval Duration `yaml:"update_interval"`
+	CheckpointFile string   `yaml:"checkpoint_file"`
+	RewardGoal     string   `yaml:"reward_goal"`
+}
+
+// GoalRule is the configuration of a backend response that is counted as a goal
+type GoalRule struct {
+	Name        string `yaml:"name"`
+	Method      string `yaml:"method"`
+	Path        string `yaml:"path"`
+	StatusCodes []int  `yaml:"status_codes"`
+	ValueHeader string `yaml:"value_header"`
+}
+
+// Schedule is the configuration of how the probability of a version changes over time
+// Every step is set either at an absolute time, or after a duration from the start
+type Schedule struct {
+	Start       time.Time      `yaml:"start"`
+	Interpolate bool           `yaml:"interpolate"`
+	Steps       []ScheduleStep `yaml:"steps"`
+}
+
+// ScheduleStep is the configuration of one step of a schedule
+type ScheduleStep struct {
+	At          time.Time `yaml:"at"`
+	After       *Duration `yaml:"after"`
+	Probability float64   `yaml:"probability"`
+}
+
+// Allowlist is the configuration of the users that are pinned to a version
+type Allowlist struct {
+	Header      string   `yaml:"header"`
+	IDs         []string `yaml:"ids"`
+	Claim       string   `yaml:"claim"`
+	ClaimValues []string `yaml:"claim_values"`
+	IPs         []string `yaml:"ips"`
+}
+
+// Experiment is the configuration of one experiment that is run together with the main experiment
+type Experiment struct {
+	Name      string    `yaml:"name"`
+	Salt      string    `yaml:"salt"`
+	Scope     Scope     `yaml:"scope"`
+	Targeting string    `yaml:"targeting"`
+	Start     time.Time `yaml:"start"`
+	End       time.Time `yaml:"end"`
+	Winner    string    `yaml:"winner"`
+	Bandit    *Bandit   `yaml:"bandit"`
+	Versions  []Version `yaml:"versions"`
+}
+
+// Scope is the configuration of which requests an experiment applies to
+type Scope struct {
+	Hosts        []string `yaml:"hosts"`
+	PathPrefixes []string `yaml:"path_prefixes"`
+	PathGlobs    []string `yaml:"path_globs"`
+	PathRegexps  []string `yaml:"path_regexps"`
+
+	ExcludeHosts        []string `yaml:"exclude_hosts"`
+	ExcludePathPrefixes []string `yaml:"exclude_path_prefixes"`
+	ExcludePathGlobs    []string `yaml:"exclude_path_globs"`
+	ExcludePathRegexps  []string `yaml:"exclude_path_regexps"`
+}
+
+// HealthCheck is the configuration of the active health checking of a version
+type HealthCheck struct {
+	Path               string   `yaml:"path"`
+	Interval           Duration `yaml:"interval"`
+	Timeout            Duration `yaml:"timeout"`
+	ExpectedStatus     int      `yaml:"expected_status"`
+	HealthyThreshold   int      `yaml:"healthy_threshold"`
+	UnhealthyThreshold int      `yaml:"unhealthy_threshold"`
+}
+
+// Duration is a duration that can be parsed from strings like "7d" or "1h30m"
+type Duration time.Duration
+
+// UnmarshalYAML parses the duration from a yaml string
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := revaboxytime.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", node.Line, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the configuration used if nothing else is set
+func Default() *Config {
+	return &Config{
+		Port:                 "80",
+		ConfigReloadInterval: Duration(5 * time.Second),
+		envSources:           map[string]string{},
+	}
+}
+
+// Load reads the configuration from a YAML or JSON file, on top of the default configuration
+func Load(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parse(file, data)
+}
+
+func parse(file string, data []byte) (*Config, error) {
+	config := Default()
+	config.file = file
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	config.root = &root
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%s: %s", file, strings.Join(typeErr.Errors, "\n"+file+": "))
+		}
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return config, nil
+}
+
+// Build validates the configuration and creates the versions and settings used to create revaboxy
+// All validation errors are returned together, each pointing at the line or environment variable of the invalid value
+func (c *Config) Build() ([]revaboxy.Version, []revaboxy.Setting, error) {
+	b := &builder{config: c}
+
+	versions := b.versions([]interface{}{"versions"}, c.Versions)
+	experiments := b.experiments()
+	settings := b.settings()
+	for _, e := range experiments {
+		settings = append(settings, revaboxy.WithExperiment(e))
+	}
+
+	if err := b.err(); err != nil {
+		return nil, nil, err
+	}
+	return versions, settings, nil
+}
+
+// BuildVersions validates the configuration and creates the versions of the main experiment and the other experiments,
+// it is used to update the versions of a running proxy
+func (c *Config) BuildVersions() ([]revaboxy.Version, []revaboxy.Experiment, error) {
+	b := &builder{config: c}
+
+	versions := b.versions([]interface{}{"versions"}, c.Versions)
+	experiments := b.experiments()
+	// The settings can not be changed on a running proxy, but are still validated
+	b.settings()
+
+	if err := b.err(); err != nil {
+		return nil, nil, err
+	}
+	return versions, experiments, nil
+}
+
+// Addr is the address the proxy should listen on
+func (c *Config) Addr() string {
+	return c.Host + ":" + c.Port
+}
+
+// AdminAddr is the address the admin endpoints should listen on
+func (c *Config) AdminAddr() string {
+	return c.AdminHost + ":" + c.AdminPort
+}
+
+type builder struct {
+	config *Config
+	errs   []string
+}
+
+func (b *builder) err() error {
+	if len(b.errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%s", strings.Join(b.errs, "\n"))
+	}
+	return nil
+}
+
+// fieldError adds an error about the field at path, e.g. ("versions", 1, "url")
+func (b *builder) fieldError(path []interface{}, format string, args ...interface{}) {
+	name := pathName(path)
+	msg := fmt.Sprintf(format, args...)
+
+	for i := len(path); i > 0; i-- {
+		if env, ok := b.config.envSources[pathName(path[:i])]; ok {
+			b.errs = append(b.errs, fmt.Sprintf("%s: %s", env, msg))
+			return
+		}
+	}
+	if node := findNode(b.config.root, path); node != nil {
+		b.errs = append(b.errs, fmt.Sprintf("%s:%d: %s: %s", b.config.file, node.Line, name, msg))
+		return
+	}
+	b.errs = append(b.errs, fmt.Sprintf("%s: %s", name, msg))
+}
+
+// versions validates the versions at path, e.g. ("versions") or ("experiments", 0, "versions")
+func (b *builder) versions(path []interface{}, vv []Version) []revaboxy.Version {
+	if len(vv) == 0 {
+		b.fieldError(path, "at least one version has to be configured")
+		return nil
+	}
+
+	versions := make([]revaboxy.Version, 0, len(vv))
+	names := map[string]bool{}
+	totalProbability := 0.0
+	for i, v := range vv {
+		if v.Name == "" {
+			b.fieldError(subPath(path, i), "name is missing")
+		} else if names[v.Name] {
+			b.fieldError(subPath(path, i, "name"), `duplicate name "%s"`, v.Name)
+		}
+		names[v.Name] = true
+
+		var u *url.URL
+		if v.URL == "" {
+			b.fieldError(subPath(path, i), "url is missing")
+		} else {
+			u = b.url(subPath(path, i, "url"), v.URL)
+		}
+		urls := make([]*url.URL, 0, len(v.URLs))
+		for j, rawURL := range v.URLs {
+			urls = append(urls, b.url(subPath(path, i, "urls", j), rawURL))
+		}
+
+		loadBalancing, err := parseLoadBalancing(v.LoadBalancing)
+		if err != nil {
+			b.fieldError(subPath(path, i, "load_balancing"), "%s", err)
+		}
+
+		if v.Probability < 0 || v.Probability > 1 {
+			b.fieldError(subPath(path, i, "probability"), "must be between 0 and 1, got %v", v.Probability)
+		}
+		totalProbability += v.Probability
+		if v.MinShare < 0 || v.MinShare > 1 {
+			b.fieldError(subPath(path, i, "min_share"), "must be between 0 and 1, got %v", v.MinShare)
+		}
+		if v.MaxShare < 0 || v.MaxShare > 1 {
+			b.fieldError(subPath(path, i, "max_share"), "must be between 0 and 1, got %v", v.MaxShare)
+		} else if v.MaxShare != 0 && v.MinShare > v.MaxShare {
+			b.fieldError(subPath(path, i, "min_share"), "should not be more than max_share")
+		}
+
+		versions = append(versions, revaboxy.Version{
+			Name:          v.Name,
+			URL:           u,
+			URLs:          urls,
+			LoadBalancing: loadBalancing,
+			Probability:   v.Probability,
+			HealthCheck:   b.healthCheck(subPath(path, i, "health_check"), v.HealthCheck),
+			Allowlist:     b.allowlist(subPath(path, i, "allowlist"), v.Allowlist),
+			Schedule:      b.schedule(subPath(path, i, "schedule"), v.Schedule),
+			MinShare:      v.MinShare,
+			MaxShare:      v.MaxShare,
+		})
+	}
+
+	if !names[revaboxy.DefaultName] {
+		b.fieldError(path, `a version with the name "%s" needs to exist`, revaboxy.DefaultName)
+	}
+	if totalProbability > 1 {
+		b.fieldError(path, "the total probability is more than 1 (%v)", totalProbability)
+	}
+
+	return versions
+}
+
+func (b *builder) experiments() []revaboxy.Experiment {
+	experiments := make([]revaboxy.Experiment, 0, len(b.config.Experiments))
+	names := map[string]bool{}
+	for i, e := range b.config.Experiments {
+		path := []interface{}{"experiments", i}
+		if e.Name == "" {
+			b.fieldError(path, "name is missing")
+		} else if names[e.Name] {
+			b.fieldError(subPath(path, "name"), `duplicate name "%s"`, e.Name)
+		}
+		names[e.Name] = true
+
+		experiments = append(experiments, revaboxy.Experiment{
+			Name:      e.Name,
+			Salt:      e.Salt,
+			Versions:  b.versions(subPath(path, "versions"), e.Versions),
+			Scope:     b.scope(subPath(path, "scope"), e.Scope),
+			Targeting: b.targeting(subPath(path, "targeting"), e.Targeting),
+			Window:    b.window(path, e.Start, e.End, e.Winner, e.Versions),
+			Bandit:    b.bandit(subPath(path, "bandit"), e.Bandit),
+		})
+	}
+	return experiments
+}
+
+func (b *builder) scope(scopePath []interface{}, s Scope) revaboxy.Scope {
+	field := func(name string) []interface{} {
+		return subPath(scopePath, name)
+	}
+
+	b.globs(field("hosts"), s.Hosts)
+	b.globs(field("exclude_hosts"), s.ExcludeHosts)
+	b.pathPrefixes(field("path_prefixes"), s.PathPrefixes)
+	b.pathPrefixes(field("exclude_path_prefixes"), s.ExcludePathPrefixes)
+	b.globs(field("path_globs"), s.PathGlobs)
+	b.globs(field("exclude_path_globs"), s.ExcludePathGlobs)
+
+	return revaboxy.Scope{
+		Hosts:               s.Hosts,
+		PathPrefixes:        s.PathPrefixes,
+		PathGlobs:           s.PathGlobs,
+		PathRegexps:         b.regexps(field("path_regexps"), s.PathRegexps),
+		ExcludeHosts:        s.ExcludeHosts,
+		ExcludePathPrefixes: s.ExcludePathPrefixes,
+		ExcludePathGlobs:    s.ExcludePathGlobs,
+		ExcludePathRegexps:  b.regexps(field("exclude_path_regexps"), s.ExcludePathRegexps),
+	}
+}
+
+// window validates the start, end and winner of the experiment at path, nil is returned if none of them are set
+func (b *builder) window(path []interface{}, start, end time.Time, winner string, vv []Version) *revaboxy.Window {
+	if start.IsZero() && end.IsZero() && winner == "" {
+		return nil
+	}
+	endField, winnerField := "end", "winner"
+	if len(path) == 0 {
+		endField, winnerField = "experiment_end", "experiment_winner"
+	}
+
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		b.fieldError(subPath(path, endField), "should be after the start")
+	}
+	if winner != "" {
+		found := false
+		for _, v := range vv {
+			found = found || v.Name == winner
+		}
+		if !found {
+			b.fieldError(subPath(path, winnerField), `there is no version with the name "%s"`, winner)
+		}
+	}
+
+	return &revaboxy.Window{
+		Start:  start,
+		End:    end,
+		Winner: winner,
+	}
+}
+
+// bandit validates the bandit config at path, the flat bandit_* fields are used for the main experiment if path is empty
+func (b *builder) bandit(path []interface{}, c *Bandit) *revaboxy.Bandit {
+	if c == nil {
+		return nil
+	}
+	field := func(name string) []interface{} {
+		if len(path) == 0 {
+			return []interface{}{"bandit_" + name}
+		}
+		return subPath(path, name)
+	}
+
+	strategy, err := parseBanditStrategy(c.Strategy)
+	if err != nil {
+		b.fieldError(field("strategy"), "%s", err)
+	}
+	if c.Epsilon != nil && (*c.Epsilon < 0 || *c.Epsilon > 1) {
+		b.fieldError(field("epsilon"), "must be between 0 and 1, got %v", *c.Epsilon)
+	}
+	if c.UpdateInterval < 0 {
+		b.fieldError(field("update_interval"), "may not be negative")
+	}
+
+	return &revaboxy.Bandit{
+		Strategy:       strategy,
+		Epsilon:        c.Epsilon,
+		RewardHeader:   c.RewardHeader,
+		UpdateInterval: time.Duration(c.UpdateInterval),
+		CheckpointFile: c.CheckpointFile,
+		RewardGoal:     c.RewardGoal,
+	}
+}
+
+func (b *builder) sampleRatioCheck() revaboxy.SampleRatioCheck {
+	c := b.config
+	if c.SampleRatioThreshold < 0 || c.SampleRatioThreshold >= 1 {
+		b.fieldError([]interface{}{"sample_ratio_threshold"}, "must be between 0 and 1, got %v", c.SampleRatioThreshold)
+	}
+	if c.SampleRatioInterval < 0 {
+		b.fieldError([]interface{}{"sample_ratio_interval"}, "may not be negative")
+	}
+	if c.SampleRatioWindow < 0 {
+		b.fieldError([]interface{}{"sample_ratio_window"}, "may not be negative")
+	} else if c.SampleRatioWindow > 0 && c.SampleRatioInterval > c.SampleRatioWindow {
+		b.fieldError([]interface{}{"sample_ratio_window"}, "should not be shorter than sample_ratio_interval")
+	}
+	if c.SampleRatioMinUsers < 0 {
+		b.fieldError([]interface{}{"sample_ratio_min_users"}, "may not be negative")
+	}
+
+	return revaboxy.SampleRatioCheck{
+		Threshold: c.SampleRatioThreshold,
+		Interval:  time.Duration(c.SampleRatioInterval),
+		Window:    time.Duration(c.SampleRatioWindow),
+		MinUsers:  uint64(c.SampleRatioMinUsers),
+	}
+}
+
+func (b *builder) eventLog() revaboxy.EventLog {
+	c := b.config
+	if c.EventFileMaxSize < 0 {
+		b.fieldError([]interface{}{"event_file_max_size"}, "may not be negative")
+	}
+	if c.EventFileMaxFiles < 0 {
+		b.fieldError([]interface{}{"event_file_max_files"}, "may not be negative")
+	}
+	if c.EventBufferSize < 0 {
+		b.fieldError([]interface{}{"event_buffer_size"}, "may not be negative")
+	}
+
+	return revaboxy.EventLog{
+		File: revaboxy.EventFile{
+			Path:     c.EventFile,
+			MaxSize:  int64(c.EventFileMaxSize),
+			MaxFiles: c.EventFileMaxFiles,
+		},
+		BufferSize: c.EventBufferSize,
+	}
+}
+
+// stickiness validates the assignment store, the file store is opened when the proxy is created
+func (b *builder) stickiness() revaboxy.Stickiness {
+	c := b.config
+	stickiness := revaboxy.Stickiness{}
+
+	switch strings.ToLower(c.AssignmentStore) {
+	case "memory":
+		if c.AssignmentStoreSize < 0 {
+			b.fieldError([]interface{}{"assignment_store_size"}, "may not be negative")
+		}
+		stickiness.Store = revaboxy.NewMemoryStore(c.AssignmentStoreSize)
+	case "file":
+		if c.AssignmentStoreFile == "" {
+			b.fieldError([]interface{}{"assignment_store"}, "assignment_store_file is needed for the file store")
+		}
+		stickiness.File = c.AssignmentStoreFile
+	case "redis":
+		if c.AssignmentStoreRedisAddr == "" {
+			b.fieldError([]interface{}{"assignment_store"}, "assignment_store_redis_addr is needed for the redis store")
+		}
+		if c.AssignmentStoreRedisDB < 0 {
+			b.fieldError([]interface{}{"assignment_store_redis_db"}, "may not be negative")
+		}
+		stickiness.Store = revaboxy.NewRedisStore(revaboxy.RedisOptions{
+			Addr:     c.AssignmentStoreRedisAddr,
+			Password: c.AssignmentStoreRedisPassword,
+			DB:       c.AssignmentStoreRedisDB,
+		})
+	default:
+		b.fieldError([]interface{}{"assignment_store"}, `unknown store "%s", should be memory, file or redis`, c.AssignmentStore)
+	}
+	return stickiness
+}
+
+// goals validates the goal tracking, nil is returned if it is not enabled
+func (b *builder) goals() *revaboxy.Goals {
+	c := b.config
+	if c.GoalPath == "" && len(c.GoalNames) == 0 && len(c.GoalRules) == 0 {
+		return nil
+	}
+
+	if c.GoalPath != "" && !strings.HasPrefix(c.GoalPath, "/") {
+		b.fieldError([]interface{}{"goal_path"}, `should start with "/", got "%s"`, c.GoalPath)
+	}
+	rules := make([]revaboxy.GoalRule, 0, len(c.GoalRules))
+	for i, rule := range c.GoalRules {
+		rulePath := []interface{}{"goal_rules", i}
+		if rule.Name == "" {
+			b.fieldError(rulePath, "name is missing")
+		}
+		if rule.Path == "" {
+			b.fieldError(rulePath, "path is missing")
+		} else if _, err := path.Match(rule.Path, ""); err != nil {
+			b.fieldError(subPath(rulePath, "path"), `"%s" is not a valid glob`, rule.Path)
+		}
+		for j, code := range rule.StatusCodes {
+			if code < 100 || code > 599 {
+				b.fieldError(subPath(rulePath, "status_codes", j), "%d is not a valid status code", code)
+			}
+		}
+		rules = append(rules, revaboxy.GoalRule{
+			Name:        rule.Name,
+			Method:      rule.Method,
+			Path:        rule.Path,
+			StatusCodes: rule.StatusCodes,
+			ValueHeader: rule.ValueHeader,
+		})
+	}
+
+	return &revaboxy.Goals{
+		Path:  c.GoalPath,
+		Names: c.GoalNames,
+		Rules: rules,
+	}
+}
+
+// mainBandit validates the flat bandit_* fields, nil is returned if the bandit mode is not enabled for the main experiment
+func (b *builder) mainBandit() *revaboxy.Bandit {
+	c := b.config
+	if c.BanditStrategy == "" {
+		return nil
+	}
+	return b.bandit(nil, &Bandit{
+		Strategy:       c.BanditStrategy,
+		Epsilon:        c.BanditEpsilon,
+		RewardHeader:   c.BanditRewardHeader,
+		UpdateInterval: c.BanditUpdateInterval,
+		CheckpointFile: c.BanditCheckpointFile,
+		RewardGoal:     c.BanditRewardGoal,
+	})
+}
+
+func (b *builder) schedule(path []interface{}, s *Schedule) *revaboxy.Schedule {
+	if s == nil {
+		return nil
+	}
+
+	if len(s.Steps) == 0 {
+		b.fieldError(path, "the schedule has no steps")
+	}
+	schedule := &revaboxy.Schedule{Interpolate: s.Interpolate}
+	for i, step := range s.Steps {
+		stepPath := subPath(path, "steps", i)
+		at := step.At
+		switch {
+		case !at.IsZero() && step.After != nil:
+			b.fieldError(stepPath, "only one of at and after may be set")
+		case step.After != nil && s.Start.IsZero():
+			b.fieldError(subPath(stepPath, "after"), "can only be used if the schedule has a start")
+		case step.After != nil:
+			at = s.Start.Add(time.Duration(*step.After))
+		case at.IsZero():
+			b.fieldError(stepPath, "at or after is missing")
+		}
+		if i > 0 && !at.IsZero() && !at.After(schedule.Steps[i-1].At) {
+			b.fieldError(stepPath, "should be after the previous step")
+		}
+		if step.Probability < 0 || step.Probability > 1 {
+			b.fieldError(subPath(stepPath, "probability"), "must be between 0 and 1, got %v", step.Probability)
+		}
+		schedule.Steps = append(schedule.Steps, revaboxy.ScheduleStep{At: at, Probability: step.Probability})
+	}
+	return schedule
+}
+
+func (b *builder) allowlist(path []interface{}, a *Allowlist) *revaboxy.Allowlist {
+	if a == nil {
+		return nil
+	}
+
+	if len(a.IDs) > 0 && a.Header == "" {
+		b.fieldError(subPath(path, "ids"), "can only be used together with header")
+	}
+	if len(a.ClaimValues) > 0 && a.Claim == "" {
+		b.fieldError(subPath(path, "claim_values"), "can only be used together with claim")
+	}
+	ips := make([]*net.IPNet, 0, len(a.IPs))
+	for i, r := range a.IPs {
+		ips = append(ips, b.ipRange(subPath(path, "ips", i), r))
+	}
+
+	return &revaboxy.Allowlist{
+		Header:      a.Header,
+		IDs:         a.IDs,
+		Claim:       a.Claim,
+		ClaimValues: a.ClaimValues,
+		IPs:         ips,
+	}
+}
+
+// ipRange parses an ip range in the CIDR notation, or a single ip
+func (b *builder) ipRange(path []interface{}, r string) *net.IPNet {
+	if ip := net.ParseIP(r); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	_, ipNet, err := net.ParseCIDR(r)
+	if err != nil {
+		b.fieldError(path, `"%s" is not an ip or ip range`, r)
+	}
+	return ipNet
+}
+
+func (b *builder) targeting(path []interface{}, expr string) *revaboxy.Targeting {
+	if expr == "" {
+		return nil
+	}
+	targeting, err := revaboxy.ParseTargeting(expr)
+	if err != nil {
+		b.fieldError(path, "%s", err)
+	}
+	return targeting
+}
+
+func (b *builder) pathPrefixes(listPath []interface{}, prefixes []string) {
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			b.fieldError(subPath(listPath, i), `should start with "/", got "%s"`, prefix)
+		}
+	}
+}
+
+func (b *builder) globs(listPath []interface{}, globs []string) {
+	for i, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			b.fieldError(subPath(listPath, i), `"%s" is not a valid glob`, glob)
+		}
+	}
+}
+
+func (b *builder) regexps(listPath []interface{}, exprs []string) []*regexp.Regexp {
+	regexps := make([]*regexp.Regexp, 0, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			b.fieldError(subPath(listPath, i), "%s", err)
+			continue
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps
+}
+
+func (b *builder) url(path []interface{}, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		b.fieldError(path, `"%s" is not an absolute url`, rawURL)
+	}
+	return u
+}
+
+func (b *builder) healthCheck(hcPath []interface{}, hc *HealthCheck) *revaboxy.HealthCheck {
+	if hc == nil {
+		return nil
+	}
+
+	path := func(field string) []interface{} {
+		return subPath(hcPath, field)
+	}
+	if !strings.HasPrefix(hc.Path, "/") {
+		b.fieldError(path("path"), `should start with "/", got "%s"`, hc.Path)
+	}
+	if hc.Interval < 0 {
+		b.fieldError(path("interval"), "may not be negative")
+	}
+	if hc.Timeout < 0 {
+		b.fieldError(path("timeout"), "may not be negative")
+	}
+	if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+		b.fieldError(path("expected_status"), "%d is not a valid status code", hc.ExpectedStatus)
+	}
+	if hc.HealthyThreshold < 0 {
+		b.fieldError(path("healthy_threshold"), "may not be negative")
+	}
+	if hc.UnhealthyThreshold < 0 {
+		b.fieldError(path("unhealthy_threshold"), "may not be negative")
+	}
+
+	return &revaboxy.HealthCheck{
+		Path:               hc.Path,
+		Interval:           time.Duration(hc.Interval),
+		Timeout:            time.Duration(hc.Timeout),
+		ExpectedStatus:     hc.ExpectedStatus,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+	}
+}
+
+func (b *builder) settings() []revaboxy.Setting {
+	c := b.config
+	settings := []revaboxy.Setting{}
+
+	if c.ConfigReloadInterval < 0 {
+		b.fieldError([]interface{}{"config_reload_interval"}, "may not be negative")
+	}
+
+	if c.Scope != nil {
+		settings = append(settings, revaboxy.WithScope(b.scope([]interface{}{"scope"}, *c.Scope)))
+	}
+
+	if targeting := b.targeting([]interface{}{"targeting"}, c.Targeting); targeting != nil {
+		settings = append(settings, revaboxy.WithTargeting(targeting))
+	}
+	if window := b.window(nil, c.ExperimentStart, c.ExperimentEnd, c.ExperimentWinner, c.Versions); window != nil {
+		settings = append(settings, revaboxy.WithWindow(*window))
+	}
+	if bandit := b.mainBandit(); bandit != nil {
+		settings = append(settings, revaboxy.WithBandit(*bandit))
+	}
+
+	if c.HeaderName != "" {
+		settings = append(settings, revaboxy.WithHeaderName(c.HeaderName))
+	}
+	if c.SpoofedHeaderPolicy != "" {
+		policy, err := parseSpoofedHeaderPolicy(c.SpoofedHeaderPolicy)
+		if err != nil {
+			b.fieldError([]interface{}{"spoofed_header_policy"}, "%s", err)
+		}
+		settings = append(settings, revaboxy.WithSpoofedHeaderPolicy(policy))
+	}
+
+	if c.ResponseHeader != "" {
+		settings = append(settings, revaboxy.WithResponseHeader(c.ResponseHeader))
+	}
+
+	if c.CookieName != "" {
+		settings = append(settings, revaboxy.WithCookieName(c.CookieName))
+	}
+	if c.CookieHTTPOnly {
+		settings = append(settings, revaboxy.WithCookieHTTPOnly(true))
+	}
+	if c.CookieExpiry != 0 {
+		if c.CookieExpiry < 0 {
+			b.fieldError([]interface{}{"cookie_expiry"}, "may not be negative")
+		}
+		settings = append(settings, revaboxy.WithCookieExpiry(time.Duration(c.CookieExpiry)))
+	}
+	if c.CookieSigningKey != "" {
+		verificationKeys := make([][]byte, 0, len(c.CookieVerificationKeys))
+		for _, key := range c.CookieVerificationKeys {
+			verificationKeys = append(verificationKeys, []byte(key))
+		}
+		settings = append(settings, revaboxy.WithCookieSigningKey([]byte(c.CookieSigningKey), verificationKeys...))
+	} else if len(c.CookieVerificationKeys) > 0 {
+		b.fieldError([]interface{}{"cookie_verification_keys"}, "can only be used together with cookie_signing_key")
+	}
+
+	if c.EjectionDuration != 0 {
+		if c.EjectionDuration < 0 {
+			b.fieldError([]interface{}{"ejection_duration"}, "may not be negative")
+		}
+		settings = append(settings, revaboxy.WithEjectionDuration(time.Duration(c.EjectionDuration)))
+	}
+
+	if len(c.FailoverStatusCodes) > 0 {
+		for i, code := range c.FailoverStatusCodes {
+			if code < 100 || code > 599 {
+				b.fieldError([]interface{}{"failover_status_codes", i}, "%d is not a valid status code", code)
+			}
+		}
+		if c.FailoverMaxBodySize < 0 {
+			b.fieldError([]interface{}{"failover_max_body_size"}, "may not be negative")
+		}
+		settings = append(settings, revaboxy.WithFailoverPolicy(revaboxy.FailoverPolicy{
+			StatusCodes: c.FailoverStatusCodes,
+			MaxBodySize: int64(c.FailoverMaxBodySize),
+			Header:      c.FailoverHeader,
+		}))
+	}
+
+	if c.OverrideSecret != "" || len(c.OverrideAllowedIPs) > 0 {
+		allowedIPs := make([]*net.IPNet, 0, len(c.OverrideAllowedIPs))
+		for i, r := range c.OverrideAllowedIPs {
+			allowedIPs = append(allowedIPs, b.ipRange([]interface{}{"override_allowed_ips", i}, r))
+		}
+		settings = append(settings, revaboxy.WithOverride(revaboxy.Override{
+			Query:        c.OverrideQuery,
+			Header:       c.OverrideHeader,
+			Secret:       c.OverrideSecret,
+			SecretHeader: c.OverrideSecretHeader,
+			SecretQuery:  c.OverrideSecretQuery,
+			AllowedIPs:   allowedIPs,
+		}))
+	}
+
+	if c.SampleRatioCheck {
+		settings = append(settings, revaboxy.WithSampleRatioCheck(b.sampleRatioCheck()))
+	}
+	if c.EventFile != "" {
+		settings = append(settings, revaboxy.WithEventLog(b.eventLog()))
+	}
+	if goals := b.goals(); goals != nil {
+		settings = append(settings, revaboxy.WithGoals(*goals))
+	}
+	if c.AssignmentStore != "" {
+		settings = append(settings, revaboxy.WithStickiness(b.stickiness()))
+	}
+
+	if c.BucketingHeader != "" || c.BucketingCookie != "" || c.BucketingQuery != "" {
+		settings = append(settings, revaboxy.WithBucketingKey(revaboxy.BucketingKey{
+			Header: c.BucketingHeader,
+			Cookie: c.BucketingCookie,
+			Query:  c.BucketingQuery,
+			Salt:   c.BucketingSalt,
+		}))
+	}
+	if c.VisitorSalt != "" {
+		settings = append(settings, revaboxy.WithVisitorSalt(c.VisitorSalt))
+	}
+
+	return settings
+}
+
+func parseSpoofedHeaderPolicy(s string) (revaboxy.SpoofedHeaderPolicy, error) {
+	switch strings.ToLower(s) {
+	case "strip":
+		return revaboxy.StripSpoofedHeader, nil
+	case "log":
+		return revaboxy.LogSpoofedHeader, nil
+	case "reject":
+		return revaboxy.RejectSpoofedHeader, nil
+	}
+	return 0, fmt.Errorf(`unknown policy "%s", should be strip, log or reject`, s)
+}
+
+func parseBanditStrategy(s string) (revaboxy.BanditStrategy, error) {
+	switch strings.ToLower(s) {
+	case "", "thompson_sampling":
+		return revaboxy.ThompsonSampling, nil
+	case "epsilon_greedy":
+		return revaboxy.EpsilonGreedy, nil
+	}
+	return 0, fmt.Errorf(`unknown strategy "%s", should be thompson_sampling or epsilon_greedy`, s)
+}
+
+func parseLoadBalancing(s string) (revaboxy.LoadBalancing, error) {
+	switch strings.ToLower(s) {
+	case "", "round_robin":
+		return revaboxy.RoundRobin, nil
+	case "random":
+		return revaboxy.Random, nil
+	case "least_outstanding":
+		return revaboxy.LeastOutstanding, nil
+	}
+	return 0, fmt.Errorf(`unknown strategy "%s", should be round_robin, random or least_outstanding`, s)
+}
+
+// subPath creates a new path with the elements added to the end of path
+func subPath(path []interface{}, elems ...interface{}) []interface{} {
+	sub := make([]interface{}, 0, len(path)+len(elems))
+	sub = append(sub, path...)
+	return append(sub, elems...)
+}
+
+// pathName formats a path like ("versions", 1, "url") as "versions[1].url"
+func pathName(path []interface{}) string {
+	var sb strings.Builder
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString(p)
+		case int:
+			fmt.Fprintf(&sb, "[%d]", p)
+		}
+	}
+	return sb.String()
+}
+
+// findNode finds the yaml node at the path, mapping keys are used for strings and sequence indexes for ints
+func findNode(node *yaml.Node, path []interface{}) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return nil
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == p {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if node.Kind != yaml.SequenceNode || p >= len(node.Content) {
+				return nil
+			}
+			next = node.Content[p]
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
@@ -0,0 +1,591 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lindell/revaboxy/pkg/revaboxy"
+)
+
+const yamlConfig = `
+port: "8080"
+cookie_name: custom
+cookie_expiry: 3d
+versions:
+  - name: default
+    url: http://default.test
+    probability: 0.6
+  - name: green
+    url: http://green.test/?a=b
+    probability: 0.4
+    health_check:
+      path: /healthz
+      interval: 5s
+    allowlist:
+      header: X-User-Id
+      ids: ["42"]
+`
+
+const jsonConfig = `{
+	"port": "8080",
+	"cookie_name": "custom",
+	"cookie_expiry": "3d",
+	"versions": [
+		{"name": "default", "url": "http://default.test", "probability": 0.6},
+		{"name": "green", "url": "http://green.test/?a=b", "probability": 0.4, "health_check": {"path": "/healthz", "interval": "5s"}, "allowlist": {"header": "X-User-Id", "ids": ["42"]}}
+	]
+}`
+
+func TestParse(t *testing.T) {
+	for name, data := range map[string]string{"config.yaml": yamlConfig, "config.json": jsonConfig} {
+		t.Run(name, func(t *testing.T) {
+			config, err := parse(name, []byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			versions, settings, err := config.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if real, expected := config.Addr(), ":8080"; real != expected {
+				t.Errorf("expected addr %s, got %s", expected, real)
+			}
+			if real, expected := len(settings), 2; real != expected {
+				t.Errorf("expected %d settings, got %d", expected, real)
+			}
+			if real, expected := len(versions), 2; real != expected {
+				t.Fatalf("expected %d versions, got %d", expected, real)
+			}
+			if real, expected := versions[1].URL.String(), "http://green.test/?a=b"; real != expected {
+				t.Errorf("expected url %s, got %s", expected, real)
+			}
+			if versions[1].HealthCheck == nil || versions[1].HealthCheck.Interval != 5*time.Second {
+				t.Errorf("expected a health check with a 5s interval, got %+v", versions[1].HealthCheck)
+			}
+			if versions[1].Allowlist == nil || versions[1].Allowlist.Header != "X-User-Id" {
+				t.Errorf("expected an allowlist with the X-User-Id header, got %+v", versions[1].Allowlist)
+			}
+		})
+	}
+}
+
+func TestExperiments(t *testing.T) {
+	data := `
+versions:
+  - name: default
+    url: http://default.test
+experiments:
+  - name: checkout
+    salt: checkout-2020
+    targeting: mobile() || query("beta")
+    scope:
+      path_prefixes:
+        - /checkout
+      exclude_path_regexps:
+        - \.js$
+    versions:
+      - name: default
+        url: http://checkout.test
+        probability: 0.5
+      - name: one-click
+        url: http://checkout-one-click.test
+        probability: 0.5
+`
+	config, err := parse("config.yaml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, settings, err := config.Build(); err != nil {
+		t.Fatal(err)
+	} else if real, expected := len(settings), 1; real != expected {
+		t.Errorf("expected %d settings, got %d", expected, real)
+	}
+
+	_, experiments, err := config.BuildVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real, expected := len(experiments), 1; real != expected {
+		t.Fatalf("expected %d experiments, got %d", expected, real)
+	}
+	e := experiments[0]
+	if e.Name != "checkout" || e.Salt != "checkout-2020" || len(e.Versions) != 2 || len(e.Scope.PathPrefixes) != 1 || len(e.Scope.ExcludePathRegexps) != 1 || e.Targeting == nil {
+		t.Errorf("unexpected experiment %+v", e)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	data := `
+versions:
+  - name: default
+    url: http://default.test
+  - name: green
+    url: http://green.test
+    schedule:
+      start: 2020-06-01T00:00:00Z
+      interpolate: true
+      steps:
+        - after: 0s
+          probability: 0.01
+        - after: 1d
+          probability: 0.1
+        - at: 2020-06-04T00:00:00Z
+          probability: 0.5
+`
+	config, err := parse("config.yaml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, _, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedule := versions[1].Schedule
+	if schedule == nil || !schedule.Interpolate || len(schedule.Steps) != 3 {
+		t.Fatalf("expected an interpolated schedule with 3 steps, got %+v", schedule)
+	}
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, expected := range []time.Time{start, start.Add(24 * time.Hour), start.Add(72 * time.Hour)} {
+		if real := schedule.Steps[i].At; !real.Equal(expected) {
+			t.Errorf("expected step %d at %s, got %s", i, expected, real)
+		}
+	}
+}
+
+func TestBandit(t *testing.T) {
+	data := `
+versions:
+  - name: default
+    url: http://default.test
+    max_share: 0.8
+  - name: green
+    url: http://green.test
+    min_share: 0.1
+bandit_strategy: epsilon_greedy
+bandit_epsilon: 0.2
+bandit_update_interval: 1m
+experiments:
+  - name: checkout
+    bandit:
+      checkpoint_file: /var/lib/revaboxy/checkout.json
+      epsilon: 0
+    versions:
+      - name: default
+        url: http://default.test
+`
+	config, err := parse("config.yaml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, experiments, err := config.BuildVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if versions[0].MaxShare != 0.8 || versions[1].MinShare != 0.1 {
+		t.Errorf("expected the shares to be set, got %v and %v", versions[0].MaxShare, versions[1].MinShare)
+	}
+	bandit := experiments[0].Bandit
+	if bandit == nil || bandit.Strategy != revaboxy.ThompsonSampling || bandit.CheckpointFile != "/var/lib/revaboxy/checkout.json" {
+		t.Errorf("expected a thompson sampling bandit with a checkpoint file, got %+v", bandit)
+	}
+	if bandit == nil || bandit.Epsilon == nil || *bandit.Epsilon != 0 {
+		t.Errorf("expected an epsilon of 0 to be kept, got %+v", bandit)
+	}
+
+	mainBandit := (&builder{config: config}).mainBandit()
+	if mainBandit == nil || mainBandit.Strategy != revaboxy.EpsilonGreedy || mainBandit.Epsilon == nil || *mainBandit.Epsilon != 0.2 || mainBandit.UpdateInterval != time.Minute {
+		t.Errorf("expected an epsilon greedy bandit, got %+v", mainBandit)
+	}
+}
+
+func TestGoals(t *testing.T) {
+	data := `
+versions:
+  - name: default
+    url: http://default.test
+goal_names: [signup]
+goal_rules:
+  - name: purchase
+    method: POST
+    path: /checkout/*/done
+    status_codes: [200, 201]
+    value_header: X-Order-Value
+`
+	config, err := parse("config.yaml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := config.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	goals := (&builder{config: config}).goals()
+	if goals == nil || len(goals.Names) != 1 || len(goals.Rules) != 1 {
+		t.Fatalf("expected one goal name and one rule, got %+v", goals)
+	}
+	if rule := goals.Rules[0]; rule.Path != "/checkout/*/done" || len(rule.StatusCodes) != 2 || rule.ValueHeader != "X-Order-Value" {
+		t.Errorf("expected the rule to be set, got %+v", rule)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			data:    "port: \"80\"\ncookie_nmae: custom\n",
+			wantErr: "config.yaml: line 2: field cookie_nmae not found",
+		},
+		{
+			name:    "wrong type",
+			data:    "versions:\n  - name: default\n    probability: much\n",
+			wantErr: "config.yaml: line 3: cannot unmarshal",
+		},
+		{
+			name:    "invalid duration",
+			data:    "cookie_expiry: 3 days\n",
+			wantErr: "line 1: time: unknown unit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse("config.yaml", []byte(tt.data))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error to contain %q, got %q", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantErrs []string
+	}{
+		{
+			name: "invalid version",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+  - name: green
+    url: not-a-url
+    probability: 1.5
+`,
+			wantErrs: []string{
+				`config.yaml:6: versions[1].url: "not-a-url" is not an absolute url`,
+				"config.yaml:7: versions[1].probability: must be between 0 and 1, got 1.5",
+				"config.yaml:3: versions: the total probability is more than 1 (1.5)",
+			},
+		},
+		{
+			name: "missing default",
+			data: `
+versions:
+  - name: green
+    url: http://green.test
+  - name: green
+    url: http://green.test
+`,
+			wantErrs: []string{
+				`config.yaml:5: versions[1].name: duplicate name "green"`,
+				`config.yaml:3: versions: a version with the name "default" needs to exist`,
+			},
+		},
+		{
+			name: "invalid load balancing",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+    urls:
+      - http://default2.test
+      - default3
+    load_balancing: fastest
+`,
+			wantErrs: []string{
+				`config.yaml:7: versions[0].urls[1]: "default3" is not an absolute url`,
+				`config.yaml:8: versions[0].load_balancing: unknown strategy "fastest"`,
+			},
+		},
+		{
+			name: "missing url",
+			data: `
+versions:
+  - name: default
+`,
+			wantErrs: []string{
+				"config.yaml:3: versions[0]: url is missing",
+			},
+		},
+		{
+			name: "invalid health check",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+    health_check:
+      path: healthz
+      expected_status: 2000
+`,
+			wantErrs: []string{
+				`config.yaml:6: versions[0].health_check.path: should start with "/", got "healthz"`,
+				"config.yaml:7: versions[0].health_check.expected_status: 2000 is not a valid status code",
+			},
+		},
+		{
+			name: "invalid experiment",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+experiments:
+  - name: checkout
+    scope:
+      path_prefixes:
+        - checkout
+    versions:
+      - name: green
+        url: http://green.test
+  - name: checkout
+    versions:
+      - name: default
+        url: http://default.test
+`,
+			wantErrs: []string{
+				`config.yaml:9: experiments[0].scope.path_prefixes[0]: should start with "/", got "checkout"`,
+				`config.yaml:11: experiments[0].versions: a version with the name "default" needs to exist`,
+				`config.yaml:13: experiments[1].name: duplicate name "checkout"`,
+			},
+		},
+		{
+			name: "invalid scope",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+scope:
+  path_globs: ["/[a"]
+  path_regexps: ["/(a"]
+  exclude_path_prefixes: [static]
+`,
+			wantErrs: []string{
+				`config.yaml:6: scope.path_globs[0]: "/[a" is not a valid glob`,
+				"config.yaml:7: scope.path_regexps[0]: error parsing regexp: missing closing )",
+				`config.yaml:8: scope.exclude_path_prefixes[0]: should start with "/", got "static"`,
+			},
+		},
+		{
+			name: "invalid targeting",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+targeting: language("sv") &&
+`,
+			wantErrs: []string{
+				`config.yaml:5: targeting: invalid targeting "language(\"sv\") &&": at position 18: unexpected end of expression`,
+			},
+		},
+		{
+			name: "invalid override ips",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+override_allowed_ips: [10.0.0.0/8, 10.0.0.0/40]
+`,
+			wantErrs: []string{
+				`config.yaml:5: override_allowed_ips[1]: "10.0.0.0/40" is not an ip or ip range`,
+			},
+		},
+		{
+			name: "invalid allowlist",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+    allowlist:
+      ids: ["42"]
+      ips: [10.0.0.0/8, office]
+`,
+			wantErrs: []string{
+				"config.yaml:6: versions[0].allowlist.ids: can only be used together with header",
+				`config.yaml:7: versions[0].allowlist.ips[1]: "office" is not an ip or ip range`,
+			},
+		},
+		{
+			name: "invalid schedule",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+    schedule:
+      steps:
+        - after: 1h
+          probability: 0.1
+        - probability: 2
+`,
+			wantErrs: []string{
+				"config.yaml:7: versions[0].schedule.steps[0].after: can only be used if the schedule has a start",
+				"config.yaml:9: versions[0].schedule.steps[1]: at or after is missing",
+				"config.yaml:9: versions[0].schedule.steps[1].probability: must be between 0 and 1, got 2",
+			},
+		},
+		{
+			name: "invalid window",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+experiment_winner: green
+experiments:
+  - name: checkout
+    start: 2020-07-01T00:00:00Z
+    end: 2020-06-01T00:00:00Z
+    versions:
+      - name: default
+        url: http://default.test
+`,
+			wantErrs: []string{
+				`config.yaml:5: experiment_winner: there is no version with the name "green"`,
+				"config.yaml:9: experiments[0].end: should be after the start",
+			},
+		},
+		{
+			name: "invalid bandit",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+    min_share: 0.5
+    max_share: 0.4
+bandit_strategy: ucb
+bandit_epsilon: 2
+`,
+			wantErrs: []string{
+				"config.yaml:5: versions[0].min_share: should not be more than max_share",
+				`config.yaml:7: bandit_strategy: unknown strategy "ucb", should be thompson_sampling or epsilon_greedy`,
+				"config.yaml:8: bandit_epsilon: must be between 0 and 1, got 2",
+			},
+		},
+		{
+			name: "invalid goals",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+goal_path: goal
+goal_rules:
+  - path: /checkout/[a
+    status_codes: [2000]
+`,
+			wantErrs: []string{
+				`config.yaml:5: goal_path: should start with "/", got "goal"`,
+				"config.yaml:7: goal_rules[0]: name is missing",
+				`config.yaml:7: goal_rules[0].path: "/checkout/[a" is not a valid glob`,
+				"config.yaml:8: goal_rules[0].status_codes[0]: 2000 is not a valid status code",
+			},
+		},
+		{
+			name: "invalid sample ratio check",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+sample_ratio_check: true
+sample_ratio_threshold: 1.5
+sample_ratio_interval: 2h
+sample_ratio_window: 1h
+`,
+			wantErrs: []string{
+				"config.yaml:6: sample_ratio_threshold: must be between 0 and 1, got 1.5",
+				"config.yaml:8: sample_ratio_window: should not be shorter than sample_ratio_interval",
+			},
+		},
+		{
+			name: "invalid event log",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+event_file: events.jsonl
+event_file_max_files: -1
+event_buffer_size: -10
+`,
+			wantErrs: []string{
+				"config.yaml:6: event_file_max_files: may not be negative",
+				"config.yaml:7: event_buffer_size: may not be negative",
+			},
+		},
+		{
+			name: "invalid assignment store",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+assignment_store: redis
+assignment_store_redis_db: -1
+`,
+			wantErrs: []string{
+				"config.yaml:5: assignment_store: assignment_store_redis_addr is needed for the redis store",
+				"config.yaml:6: assignment_store_redis_db: may not be negative",
+			},
+		},
+		{
+			name: "unknown assignment store",
+			data: `
+versions:
+  - name: default
+    url: http://default.test
+assignment_store: disk
+`,
+			wantErrs: []string{
+				`config.yaml:5: assignment_store: unknown store "disk", should be memory, file or redis`,
+			},
+		},
+		{
+			name: "invalid policy",
+			data: `
+spoofed_header_policy: ignore
+versions:
+  - name: default
+    url: http://default.test
+`,
+			wantErrs: []string{
+				`config.yaml:2: spoofed_header_policy: unknown policy "ignore"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parse("config.yaml", []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = config.Build()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, wantErr := range tt.wantErrs {
+				if !strings.Contains(err.Error(), wantErr) {
+					t.Errorf("expected error to contain %q, got %q", wantErr, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	revaboxytime "github.com/lindell/revaboxy/internal/time"
+)
+
+var versionEnvRegexp = regexp.MustCompile("^VERSION_(.*)_(URLS|URL|PROBABILITY|LOAD_BALANCING)$")
+
+var durationType = reflect.TypeOf(Duration(0))
+var timeType = reflect.TypeOf(time.Time{})
+
+// nestedFields can only be set in the config file, except for versions which are handled by applyVersionsEnv
+var nestedFields = map[string]bool{
+	"versions":    true,
+	"scope":       true,
+	"experiments": true,
+	"goal_rules":  true,
+}
+
+// ApplyEnv overrides the configuration with environment variables, in the "KEY=value" format of os.Environ
+// Every field can be set with the name of the field in upper case, lists are comma separated.
+// Versions are set with VERSION_NAME_URL, VERSION_NAME_URLS, VERSION_NAME_LOAD_BALANCING and VERSION_NAME_PROBABILITY,
+// which will add the version if it does not already exist
+func (c *Config) ApplyEnv(environ []string) error {
+	env := map[string]string{}
+	for _, e := range environ {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) == 2 {
+			env[pair[0]] = pair[1]
+		}
+	}
+
+	if err := c.applyFieldsEnv(env); err != nil {
+		return err
+	}
+	return c.applyVersionsEnv(env)
+}
+
+func (c *Config) applyFieldsEnv(env map[string]string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || nestedFields[name] {
+			continue
+		}
+
+		envName := strings.ToUpper(name)
+		value, ok := env[envName]
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %s", envName, err)
+		}
+		c.envSources[name] = envName
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := revaboxytime.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(Duration(d)))
+		return nil
+	}
+	if field.Type() == timeType {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf(`could not parse "%s" as a time like 2006-01-02T15:04:05Z`, value)
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf(`could not parse "%s" as a boolean`, value)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf(`could not parse "%s" as an integer`, value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf(`could not parse "%s" as a number`, value)
+		}
+		field.SetFloat(f)
+	case reflect.Ptr:
+		// Pointers are used for values where the zero value is different from not setting it
+		elem := reflect.New(field.Type().Elem())
+		if err := setField(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+	case reflect.Slice:
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, s := range strings.Split(value, ",") {
+			if s == "" {
+				continue
+			}
+			elem := reflect.New(field.Type().Elem()).Elem()
+			if err := setField(elem, strings.TrimSpace(s)); err != nil {
+				return err
+			}
+			list = reflect.Append(list, elem)
+		}
+		field.Set(list)
+	default:
+		return fmt.Errorf("can not be set with an environment variable")
+	}
+	return nil
+}
+
+func (c *Config) applyVersionsEnv(env map[string]string) error {
+	// Sort the names to add new versions in a predictable order
+	envNames := make([]string, 0, len(env))
+	for envName := range env {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+
+	for _, envName := range envNames {
+		value := env[envName]
+		match := versionEnvRegexp.FindStringSubmatch(envName)
+		if match == nil {
+			continue
+		}
+		name := strings.ToLower(match[1])
+
+		i := c.versionIndex(name)
+		if i < 0 {
+			c.Versions = append(c.Versions, Version{Name: name})
+			i = len(c.Versions) - 1
+		}
+
+		switch match[2] {
+		case "URL":
+			c.Versions[i].URL = value
+			c.envSources[pathName([]interface{}{"versions", i, "url"})] = envName
+		case "URLS":
+			c.Versions[i].URLs = nil
+			for _, u := range strings.Split(value, ",") {
+				if u != "" {
+					c.Versions[i].URLs = append(c.Versions[i].URLs, u)
+				}
+			}
+			c.envSources[pathName([]interface{}{"versions", i, "urls"})] = envName
+		case "LOAD_BALANCING":
+			c.Versions[i].LoadBalancing = value
+			c.envSources[pathName([]interface{}{"versions", i, "load_balancing"})] = envName
+		case "PROBABILITY":
+			probability, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf(`%s: could not parse %s probability "%s"`, envName, name, value)
+			}
+			c.Versions[i].Probability = probability
+			c.envSources[pathName([]interface{}{"versions", i, "probability"})] = envName
+		}
+	}
+	return nil
+}
+
+func (c *Config) versionIndex(name string) int {
+	for i, v := range c.Versions {
+		if v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	config, err := parse("config.yaml", []byte(yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = config.ApplyEnv([]string{
+		"PORT=9090",
+		"COOKIE_EXPIRY=1h",
+		"COOKIE_HTTP_ONLY=true",
+		"RESPONSE_HEADER=X-Revaboxy-Version",
+		"VISITOR_SALT=pepper",
+		"BANDIT_EPSILON=0",
+		"COOKIE_SIGNING_KEY=c",
+		"COOKIE_VERIFICATION_KEYS=a,b",
+		"FAILOVER_STATUS_CODES=502, 503",
+		"EXPERIMENT_END=2020-07-01T12:00:00Z",
+		"EXPERIMENT_WINNER=green",
+		"SAMPLE_RATIO_CHECK=true",
+		"SAMPLE_RATIO_MIN_USERS=500",
+		"VERSION_GREEN_PROBABILITY=0.2",
+		"VERSION_BLUE_URL=http://blue.test/?c=d&e=f",
+		"VERSION_BLUE_PROBABILITY=0.1",
+		"VERSION_BLUE_URLS=http://blue2.test,http://blue3.test",
+		"VERSION_BLUE_LOAD_BALANCING=least_outstanding",
+		"UNRELATED",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if real, expected := config.Port, "9090"; real != expected {
+		t.Errorf("expected port %s, got %s", expected, real)
+	}
+	if real, expected := config.CookieName, "custom"; real != expected {
+		t.Errorf("expected cookie name %s, got %s", expected, real)
+	}
+	if real, expected := time.Duration(config.CookieExpiry), time.Hour; real != expected {
+		t.Errorf("expected cookie expiry %s, got %s", expected, real)
+	}
+	if !config.CookieHTTPOnly || config.ResponseHeader != "X-Revaboxy-Version" {
+		t.Errorf("expected an HttpOnly cookie and the response header, got %v and %s", config.CookieHTTPOnly, config.ResponseHeader)
+	}
+	if config.BanditEpsilon == nil || *config.BanditEpsilon != 0 {
+		t.Errorf("expected the bandit epsilon to be set to 0, got %v", config.BanditEpsilon)
+	}
+	if real, expected := config.VisitorSalt, "pepper"; real != expected {
+		t.Errorf("expected the visitor salt %s, got %s", expected, real)
+	}
+	if real, expected := strings.Join(config.CookieVerificationKeys, ","), "a,b"; real != expected {
+		t.Errorf("expected verification keys %s, got %s", expected, real)
+	}
+	if real, expected := config.FailoverStatusCodes, []int{502, 503}; len(real) != 2 || real[0] != expected[0] || real[1] != expected[1] {
+		t.Errorf("expected failover status codes %v, got %v", expected, real)
+	}
+
+	if real, expected := config.ExperimentEnd, time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC); !real.Equal(expected) {
+		t.Errorf("expected experiment end %s, got %s", expected, real)
+	}
+
+	if !config.SampleRatioCheck || config.SampleRatioMinUsers != 500 {
+		t.Errorf("expected the sample ratio check with 500 min users, got %v and %d", config.SampleRatioCheck, config.SampleRatioMinUsers)
+	}
+
+	if real, expected := len(config.Versions), 3; real != expected {
+		t.Fatalf("expected %d versions, got %d", expected, real)
+	}
+	if real, expected := config.Versions[1].Probability, 0.2; real != expected {
+		t.Errorf("expected green probability %v, got %v", expected, real)
+	}
+	if real, expected := config.Versions[2].URL, "http://blue.test/?c=d&e=f"; real != expected {
+		t.Errorf("expected blue url %s, got %s", expected, real)
+	}
+	if real, expected := strings.Join(config.Versions[2].URLs, ","), "http://blue2.test,http://blue3.test"; real != expected {
+		t.Errorf("expected blue urls %s, got %s", expected, real)
+	}
+
+	versions, _, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real, expected := len(versions[2].URLs), 2; real != expected {
+		t.Errorf("expected %d additional blue urls, got %d", expected, real)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	config := Default()
+	err := config.ApplyEnv([]string{
+		"VERSION_DEFAULT_URL=http://default.test",
+		"VERSION_DEFAULT_PROBABILITY=1.5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = config.Build()
+	if expected := "VERSION_DEFAULT_PROBABILITY: must be between 0 and 1"; err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected error to contain %q, got %v", expected, err)
+	}
+
+	config = Default()
+	err = config.ApplyEnv([]string{
+		"VERSION_DEFAULT_URL=http://default.test",
+		"VERSION_DEFAULT_URLS=http://default2.test,default3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = config.Build()
+	if expected := `VERSION_DEFAULT_URLS: "default3" is not an absolute url`; err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected error to contain %q, got %v", expected, err)
+	}
+
+	err = Default().ApplyEnv([]string{"COOKIE_EXPIRY=soon"})
+	if expected := "COOKIE_EXPIRY: time: invalid duration"; err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected error to contain %q, got %v", expected, err)
+	}
+}
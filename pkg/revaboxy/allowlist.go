@@ -0,0 +1,75 @@
+package revaboxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Allowlist pins users to a version, e.g. internal users that should dogfood it
+// Allowlists are checked ahead of the cookie, targeting and probability based assignment. Pinned users are not given a cookie,
+// and are logged and counted in MetricPinned instead of the assignment metrics so that they can be excluded from the analysis
+type Allowlist struct {
+	// The header that contains the id of the user, like "X-User-Id"
+	Header string
+	// The user ids that are pinned to the version
+	IDs []string
+
+	// The name of a claim in the JWT bearer token of the Authorization header, like "email"
+	// The signature of the token is not verified by revaboxy, so this should only be used when the token has
+	// already been verified by a proxy in front of revaboxy
+	Claim string
+	// The values of the claim that are pinned to the version, compared case insensitive
+	ClaimValues []string
+
+	// The ip ranges of clients that are pinned to the version
+	IPs []*net.IPNet
+}
+
+// matches checks if the request is pinned by the allowlist, claims are the claims of the bearer token of the request
+func (a *Allowlist) matches(req *http.Request, claims map[string]interface{}) bool {
+	if a.Header != "" {
+		if id := req.Header.Get(a.Header); id != "" {
+			for _, allowed := range a.IDs {
+				if id == allowed {
+					return true
+				}
+			}
+		}
+	}
+
+	if a.Claim != "" {
+		if value, ok := claims[a.Claim].(string); ok && value != "" {
+			for _, allowed := range a.ClaimValues {
+				if strings.EqualFold(value, allowed) {
+					return true
+				}
+			}
+		}
+	}
+
+	return containsIP(a.IPs, clientIP(req))
+}
+
+// bearerClaims returns the claims of the JWT bearer token in the Authorization header, without verifying it
+// An empty map is returned if there is no token, or if it could not be parsed
+func bearerClaims(req *http.Request) map[string]interface{} {
+	claims := map[string]interface{}{}
+
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return claims
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return claims
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims
+	}
+	_ = json.Unmarshal(payload, &claims)
+	return claims
+}
@@ -0,0 +1,129 @@
+package revaboxy
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func bearerToken(payload string) string {
+	return "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestAllowlist(t *testing.T) {
+	_, office, _ := net.ParseCIDR("10.0.0.0/8")
+	allowlist := &Allowlist{
+		Header:      "X-User-Id",
+		IDs:         []string{"42"},
+		Claim:       "email",
+		ClaimValues: []string{"dogfooder@example.com"},
+		IPs:         []*net.IPNet{office},
+	}
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		remoteAddr string
+		want       bool
+	}{
+		{
+			name:   "user id",
+			header: http.Header{"X-User-Id": {"42"}},
+			want:   true,
+		},
+		{
+			name:   "other user id",
+			header: http.Header{"X-User-Id": {"43"}},
+			want:   false,
+		},
+		{
+			name:   "claim",
+			header: http.Header{"Authorization": {bearerToken(`{"email":"Dogfooder@example.com"}`)}},
+			want:   true,
+		},
+		{
+			name:   "other claim",
+			header: http.Header{"Authorization": {bearerToken(`{"email":"user@example.com"}`)}},
+			want:   false,
+		},
+		{
+			name:   "invalid token",
+			header: http.Header{"Authorization": {"Bearer dogfooder@example.com"}},
+			want:   false,
+		},
+		{
+			name:       "ip",
+			remoteAddr: "10.20.30.40:1234",
+			want:       true,
+		},
+		{
+			name:       "other ip",
+			remoteAddr: "192.168.1.1:1234",
+			want:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header = tt.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req.RemoteAddr = tt.remoteAddr
+
+			if real := allowlist.matches(req, bearerClaims(req)); real != tt.want {
+				t.Errorf("matches() = %v, want %v", real, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedVersion(t *testing.T) {
+	rt := &savingRoundtripper{}
+	m := newTestMetrics()
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 1,
+			},
+			{
+				Name:        "green",
+				URL:         mustURLParse("http://green.test"),
+				Probability: 0,
+				Allowlist: &Allowlist{
+					Header: "X-User-Id",
+					IDs:    []string{"42"},
+				},
+			},
+		},
+		WithTransport(rt),
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// A pinned user should get the version, even if another version is stored in the cookie
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-User-Id", "42")
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: DefaultName})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "green.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real := len(rec.Result().Cookies()); real != 0 {
+		t.Fatalf("expected no cookies, got %d", real)
+	}
+	if real, expected := m.counters[`revaboxy_pinned_total{version="green"}`], 1; real != expected {
+		t.Errorf("expected %d pinned requests, got %d", expected, real)
+	}
+	if real := m.counters[`revaboxy_sticky_hits_total{version="default"}`]; real != 0 {
+		t.Errorf("expected pinned requests to not be counted as sticky hits, got %d", real)
+	}
+}
@@ -0,0 +1,87 @@
+package revaboxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// AssignmentStore saves the versions assigned to users on the server
+// The key is the hashed id of the visitor, followed by ":" and the name of the experiment for experiments added with WithExperiment
+// The store is used from all requests at the same time, and has to be safe for concurrent use
+type AssignmentStore interface {
+	// Get returns the name of the version saved for the key, or an empty string if there is none or it has expired
+	Get(key string) (string, error)
+	// Set saves the name of the version for the key, it should be removed after the expiry
+	Set(key, version string, expiry time.Duration) error
+}
+
+// Stickiness saves the version assigned to every user in a store, so that users without the cookie, like API clients
+// or users that cleared their cookies, keep their version. The store is checked before a new version is selected,
+// and the saved assignments expires at the same time as the cookie
+// Users are identified by the bucketing key if it is available, and by the ip and User-Agent otherwise
+type Stickiness struct {
+	// The store the assignments are saved in. A FileStore at File is used if it is not set,
+	// and a MemoryStore with room for 100000 assignments if neither is set
+	// The store is closed together with revaboxy if it implements io.Closer
+	Store AssignmentStore
+	File  string
+}
+
+// WithStickiness saves the version assigned to every user on the server, in addition to the cookie
+func WithStickiness(s Stickiness) Setting {
+	return func(settings *settings) {
+		settings.stickiness = &s
+	}
+}
+
+// openStore opens the store of the stickiness
+func (s *Stickiness) openStore() (AssignmentStore, error) {
+	if s.Store != nil {
+		return s.Store, nil
+	}
+	if s.File != "" {
+		return NewFileStore(s.File)
+	}
+	return NewMemoryStore(0), nil
+}
+
+// storeKey returns the key of the user making the request in the assignment store
+func (e *experiment) storeKey(s *settings, req *http.Request) string {
+	key := s.visitor(req)
+	if e.name != "" {
+		key += ":" + e.name
+	}
+	return key
+}
+
+// stored returns the version saved for the user in the assignment store, or nil if there is none or it does no longer exist
+func (e *experiment) stored(s *settings, req *http.Request, vv versions) *Version {
+	if s.store == nil {
+		return nil
+	}
+	name, err := s.store.Get(e.storeKey(s, req))
+	if err != nil {
+		e.logf(s, "could not get the assignment from the store: %s", err)
+		return nil
+	}
+	return vv[name]
+}
+
+// save saves the version assigned to the user in the assignment store
+func (e *experiment) save(s *settings, req *http.Request, version string) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Set(e.storeKey(s, req), version, s.cookieExpiry); err != nil {
+		e.logf(s, "could not save the assignment in the store: %s", err)
+	}
+}
+
+// closeStore closes the assignment store if it can be closed
+func (s *settings) closeStore() error {
+	if c, ok := s.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package revaboxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStickiness(t *testing.T) {
+	m := newTestMetrics()
+	store := NewMemoryStore(10)
+	proxy, err := New(
+		[]Version{
+			{Name: DefaultName, URL: mustURLParse("http://default.test")},
+			{Name: "green", URL: mustURLParse("http://green.test"), Probability: 0.5},
+		},
+		WithTransport(&savingRoundtripper{}),
+		WithMetrics(m),
+		WithStickiness(Stickiness{Store: store}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	request := func(remoteAddr string, cookie string) string {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "api-client")
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: cookie})
+		}
+		proxy.ServeHTTP(rec, req)
+
+		resp := http.Response{Header: rec.Header()}
+		cookies := resp.Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected the cookie to be set, got %v", cookies)
+		}
+		return cookies[0].Value
+	}
+
+	// A client without cookies keeps the version it was first assigned
+	assigned := request("10.0.0.1:1000", "")
+	for i := 0; i < 20; i++ {
+		if real := request("10.0.0.1:1000", ""); real != assigned {
+			t.Fatalf("expected the saved version %s, got %s", assigned, real)
+		}
+	}
+	if real := request("10.0.0.1:1000", "removed"); real != assigned {
+		t.Errorf("expected the saved version %s to replace an invalid cookie, got %s", assigned, real)
+	}
+	if real, expected := m.counters["revaboxy_store_hits_total{version=\""+assigned+"\"}"], 21; real != expected {
+		t.Errorf("expected %d store hits, got %d", expected, real)
+	}
+	if real, expected := m.counters["revaboxy_assignments_total{version=\""+assigned+"\"}"], 1; real != expected {
+		t.Errorf("expected %d assignments, got %d", expected, real)
+	}
+
+	// Other clients are saved separately
+	for i := 0; i < 5; i++ {
+		request("10.0.0.2:1000", "")
+	}
+	if real, expected := store.Len(), 2; real != expected {
+		t.Errorf("expected %d saved assignments, got %d", expected, real)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(2)
+	store.Set("a", "green", time.Hour)
+	store.Set("b", "green", time.Hour)
+	store.Set("expired", "green", -time.Second)
+	if version, _ := store.Get("expired"); version != "" {
+		t.Errorf("expected an expired assignment to be removed, got %s", version)
+	}
+
+	// a is used, so b is the least recently used one when c is added
+	store.Set("a", "default", time.Hour)
+	store.Get("a")
+	store.Set("c", "green", time.Hour)
+	expected := map[string]string{"a": "default", "b": "", "c": "green"}
+	for key, version := range expected {
+		if real, err := store.Get(key); err != nil || real != version {
+			t.Errorf("expected %s to have the version %q, got %q (%v)", key, version, real, err)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revaboxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assignments.jsonl")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("a", "green", time.Hour)
+	store.Set("b", "green", -time.Second)
+	store.Set("a", "default", time.Hour)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partially written line, like one from a crash, is skipped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"key":"c","vers`)
+	f.Close()
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	expected := map[string]string{"a": "default", "b": "", "c": ""}
+	for key, version := range expected {
+		if real, err := store.Get(key); err != nil || real != version {
+			t.Errorf("expected %s to have the version %q, got %q (%v)", key, version, real, err)
+		}
+	}
+
+	// The file is compacted when it has doubled in size, or when the writer was behind
+	for i := 0; i < 2000; i++ {
+		store.Set("a", "green", time.Hour)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a", "green", time.Hour); err == nil {
+		t.Error("expected an error when the store is closed")
+	}
+	data, _ := ioutil.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines > 1001 {
+		t.Errorf("expected the file to be compacted, got %d lines", lines)
+	}
+	if version, _ := store.Get("a"); version != "green" {
+		t.Errorf("expected the version green after the compaction, got %s", version)
+	}
+}
+
+func TestStickinessOutOfScope(t *testing.T) {
+	rt := &savingRoundtripper{}
+	proxy, err := New(
+		testVersions(),
+		WithTransport(rt),
+		WithExperiment(testExperiment()),
+		WithStickiness(Stickiness{}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	request := func(path string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The saved version is only used instead of assigning a new one, not to forward the assignment of other experiments
+	request("/checkout")
+	if real, expected := rt.req.Header.Get("Revaboxy-Name-Checkout"), "one-click"; real != expected {
+		t.Fatalf("expected the checkout version %s, got %s", expected, real)
+	}
+	request("/")
+	if real := rt.req.Header.Get("Revaboxy-Name-Checkout"); real != "" {
+		t.Errorf("expected no checkout version outside of the scope, got %s", real)
+	}
+}
@@ -0,0 +1,114 @@
+package revaboxy
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancing is the strategy used to balance requests between the urls of a version
+type LoadBalancing int
+
+const (
+	// RoundRobin sends requests to the urls in turn
+	RoundRobin LoadBalancing = iota
+	// Random sends requests to a random url
+	Random
+	// LeastOutstanding sends requests to the url with the least requests that has not been answered yet
+	LeastOutstanding
+)
+
+// WithEjectionDuration sets for how long a url of a version is not used after a request to it has failed
+// The url will still be used if all urls of the version has been ejected. Default is 30 seconds
+func WithEjectionDuration(d time.Duration) Setting {
+	return func(s *settings) {
+		s.ejectionDuration = d
+	}
+}
+
+// balancer selects which of the urls of a version that should be used
+// The 64 bit fields used atomically are placed first to be aligned on 32 bit platforms
+type balancer struct {
+	next     uint64
+	strategy LoadBalancing
+	targets  []*target
+}
+
+type target struct {
+	// Number of requests that has been sent to the target and not been answered yet
+	outstanding int64
+	// Unix nano timestamp until which the target should not be used
+	ejectedUntil int64
+	url          *url.URL
+	// The handler of a version that is served in-process, the url is nil if it is set
+	handler http.Handler
+}
+
+func newBalancer(v *Version) *balancer {
+	b := &balancer{strategy: v.LoadBalancing}
+	if v.Handler != nil {
+		b.targets = []*target{{handler: v.Handler}}
+		return b
+	}
+	for _, u := range append([]*url.URL{v.URL}, v.URLs...) {
+		if u != nil {
+			b.targets = append(b.targets, &target{url: u})
+		}
+	}
+	return b
+}
+
+// pick selects the target to use for a request, done has to be called with the result when the request is finished
+// nil is returned if the version has no url or handler to send the request to
+func (b *balancer) pick() *target {
+	if len(b.targets) == 0 {
+		return nil
+	}
+	candidates := b.available()
+
+	var t *target
+	switch b.strategy {
+	case Random:
+		t = candidates[rand.Intn(len(candidates))]
+	case LeastOutstanding:
+		// Start at different positions to spread requests between targets with the same number of outstanding requests
+		offset := int(atomic.AddUint64(&b.next, 1) % uint64(len(candidates)))
+		for i := range candidates {
+			c := candidates[(offset+i)%len(candidates)]
+			if t == nil || atomic.LoadInt64(&c.outstanding) < atomic.LoadInt64(&t.outstanding) {
+				t = c
+			}
+		}
+	default:
+		t = candidates[atomic.AddUint64(&b.next, 1)%uint64(len(candidates))]
+	}
+
+	atomic.AddInt64(&t.outstanding, 1)
+	return t
+}
+
+// available returns the targets that are not ejected, or all targets if all of them are ejected
+func (b *balancer) available() []*target {
+	now := time.Now().UnixNano()
+	available := make([]*target, 0, len(b.targets))
+	for _, t := range b.targets {
+		if atomic.LoadInt64(&t.ejectedUntil) <= now {
+			available = append(available, t)
+		}
+	}
+	if len(available) == 0 {
+		return b.targets
+	}
+	return available
+}
+
+func (t *target) done() {
+	atomic.AddInt64(&t.outstanding, -1)
+}
+
+// eject stops the target from being used for a duration
+func (t *target) eject(d time.Duration) {
+	atomic.StoreInt64(&t.ejectedUntil, time.Now().Add(d).UnixNano())
+}
@@ -0,0 +1,142 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testBalancer(strategy LoadBalancing) *balancer {
+	return newBalancer(&Version{
+		URL: mustURLParse("http://url1.test"),
+		URLs: []*url.URL{
+			mustURLParse("http://url2.test"),
+			mustURLParse("http://url3.test"),
+		},
+		LoadBalancing: strategy,
+	})
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := testBalancer(RoundRobin)
+
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		target := b.pick()
+		counts[target.url.Host]++
+		target.done()
+	}
+
+	for _, host := range []string{"url1.test", "url2.test", "url3.test"} {
+		if real, expected := counts[host], 10; real != expected {
+			t.Errorf("expected %s to be used %d times, got %d", host, expected, real)
+		}
+	}
+}
+
+func TestBalancerRandom(t *testing.T) {
+	b := testBalancer(Random)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		target := b.pick()
+		counts[target.url.Host]++
+		target.done()
+	}
+
+	for _, host := range []string{"url1.test", "url2.test", "url3.test"} {
+		if real := counts[host]; real < 900 || real > 1100 {
+			t.Errorf("expected %s to be used around 1000 times, got %d", host, real)
+		}
+	}
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b := testBalancer(LeastOutstanding)
+
+	// Keep requests outstanding on two of the targets
+	first := b.pick()
+	second := b.pick()
+	if first == second {
+		t.Fatal("expected different targets when one target has outstanding requests")
+	}
+
+	third := b.pick()
+	if third == first || third == second {
+		t.Fatal("expected the target without outstanding requests to be used")
+	}
+
+	third.done()
+	second.done()
+	for i := 0; i < 10; i++ {
+		target := b.pick()
+		if target == first {
+			t.Fatal("expected the target with an outstanding request to not be used")
+		}
+		target.done()
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	b := testBalancer(RoundRobin)
+	b.targets[0].eject(time.Hour)
+	b.targets[1].eject(time.Hour)
+
+	for i := 0; i < 10; i++ {
+		target := b.pick()
+		if real, expected := target.url.Host, "url3.test"; real != expected {
+			t.Fatalf("expected only %s to be used, got %s", expected, real)
+		}
+		target.done()
+	}
+
+	// If all targets are ejected, all of them should be used
+	b.targets[2].eject(time.Hour)
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		target := b.pick()
+		counts[target.url.Host]++
+		target.done()
+	}
+	if real, expected := len(counts), 3; real != expected {
+		t.Fatalf("expected %d targets to be used, got %d", expected, real)
+	}
+}
+
+func TestLoadBalancedVersion(t *testing.T) {
+	proxy, err := New(
+		[]Version{
+			{
+				Name: DefaultName,
+				URL:  mustURLParse("http://failing.test"),
+				URLs: []*url.URL{
+					mustURLParse("http://working.test"),
+				},
+				Probability: 1,
+			},
+		},
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"working.test": "working-data",
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	statuses := map[int]int{}
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		proxy.ServeHTTP(rec, req)
+		statuses[rec.Code]++
+	}
+
+	// The failing url should be ejected after the first failure
+	if real, expected := statuses[http.StatusOK], 9; real < expected {
+		t.Fatalf("expected at least %d successful requests, got %d", expected, real)
+	}
+}
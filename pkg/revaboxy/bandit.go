@@ -0,0 +1,430 @@
+package revaboxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BanditStrategy is the algorithm used to allocate new users between the versions in the bandit mode
+type BanditStrategy int
+
+const (
+	// ThompsonSampling allocates new users to each version by the probability that it has the best reward rate
+	ThompsonSampling BanditStrategy = iota
+	// EpsilonGreedy allocates new users to the version with the best observed reward rate,
+	// except for the epsilon share that is allocated evenly between all versions
+	EpsilonGreedy
+)
+
+// Bandit makes the allocation of new users adaptive, shifting it towards the version with the best observed reward rate
+// The probabilities and schedules of the versions are not used, but the allocation is bounded by their MinShare and MaxShare.
+// A version is rewarded when the backend sets the reward header on a response from it
+type Bandit struct {
+	// The algorithm used to allocate new users, defaults to ThompsonSampling
+	Strategy BanditStrategy
+	// The share of new users that are allocated evenly between all versions with EpsilonGreedy, defaults to 0.1 if not set
+	// A pointer to 0 allocates all new users to the best version
+	Epsilon *float64
+	// The response header that the backend sets to reward the version, e.g. when the user converted. Defaults to "Revaboxy-Reward"
+	// The header is removed before the response is sent to the client
+	RewardHeader string
+	// Optional goal that rewards the version when it is reached, see WithGoals
+	RewardGoal string
+	// How often the allocation is recalculated and the state is checkpointed, defaults to 10s
+	UpdateInterval time.Duration
+	// The file the state is checkpointed to, and loaded from at startup. The state is only kept in memory if not set
+	CheckpointFile string
+}
+
+// WithBandit allocates new users of the main experiment adaptively instead of by the probabilities of the versions
+func WithBandit(b Bandit) Setting {
+	return func(s *settings) {
+		s.bandit = &b
+	}
+}
+
+func (b Bandit) withDefaults() Bandit {
+	if b.Epsilon == nil {
+		epsilon := 0.1
+		b.Epsilon = &epsilon
+	}
+	if b.RewardHeader == "" {
+		b.RewardHeader = "Revaboxy-Reward"
+	}
+	if b.UpdateInterval <= 0 {
+		b.UpdateInterval = 10 * time.Second
+	}
+	return b
+}
+
+func (b *Bandit) validate() error {
+	if b.Strategy != ThompsonSampling && b.Strategy != EpsilonGreedy {
+		return fmt.Errorf("unknown bandit strategy %d", b.Strategy)
+	}
+	if b.Epsilon != nil && (*b.Epsilon < 0 || *b.Epsilon > 1) {
+		return fmt.Errorf("the epsilon of the bandit needs to be between 0 and 1")
+	}
+	return nil
+}
+
+// banditArm is the observed rewards of a version
+type banditArm struct {
+	// The number of users that has been assigned the version
+	Exposures uint64 `json:"exposures"`
+	Rewards   uint64 `json:"rewards"`
+}
+
+// bandit is the running state of the bandit mode of an experiment
+type bandit struct {
+	settings   *settings
+	experiment *experiment
+	config     Bandit
+
+	mu   sync.Mutex
+	arms map[string]*banditArm
+	rand *rand.Rand
+
+	// The current allocation, map[string]float64
+	shares atomic.Value
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// thompsonDraws is the number of samples used to estimate the probability that each version is the best
+const thompsonDraws = 1000
+
+func newBandit(s *settings, e *experiment, config Bandit) (*bandit, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	b := &bandit{
+		settings:   s,
+		experiment: e,
+		config:     config.withDefaults(),
+		arms:       map[string]*banditArm{},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	b.shares.Store(map[string]float64{})
+
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// start recalculates the allocation and checkpoints the state every update interval, until the bandit is closed
+func (b *bandit) start() {
+	b.stop = make(chan struct{})
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(b.config.UpdateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.update(b.experiment.getVersions())
+				b.checkpoint()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the background work and checkpoints the state a last time
+func (b *bandit) close() {
+	if b == nil || b.stop == nil {
+		return
+	}
+	close(b.stop)
+	b.wg.Wait()
+	b.stop = nil
+	b.checkpoint()
+}
+
+// expose records that a new user has been assigned the version
+func (b *bandit) expose(version string) {
+	b.mu.Lock()
+	b.arm(version).Exposures++
+	b.mu.Unlock()
+}
+
+// reward records that the version has been rewarded
+func (b *bandit) reward(version string) {
+	b.mu.Lock()
+	b.arm(version).Rewards++
+	b.mu.Unlock()
+	b.settings.metrics.IncCounter(MetricRewards, b.experiment.labels(version))
+}
+
+// rewardResponse rewards the assigned version if the reward header is set on the response, and removes the header
+// A header with the value "0" or "false" is not counted as a reward, and neither are responses to users that are not
+// part of the experiment, like users that are out of scope, pinned or had a forced version
+func (b *bandit) rewardResponse(a *assignment, resp *http.Response) {
+	value := resp.Header.Get(b.config.RewardHeader)
+	if value == "" {
+		return
+	}
+	resp.Header.Del(b.config.RewardHeader)
+	if !a.tracked || value == "0" || strings.EqualFold(value, "false") {
+		return
+	}
+	b.reward(a.version.Name)
+}
+
+// arm returns the arm of the version, b.mu has to be held
+func (b *bandit) arm(version string) *banditArm {
+	arm, ok := b.arms[version]
+	if !ok {
+		arm = &banditArm{}
+		b.arms[version] = arm
+	}
+	return arm
+}
+
+// stats returns a copy of the arm of the version
+func (b *bandit) stats(version string) banditArm {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if arm, ok := b.arms[version]; ok {
+		return *arm
+	}
+	return banditArm{}
+}
+
+// pick maps n, a number in the range [0,1), onto the current allocation
+func (b *bandit) pick(vv versions, n float64) *Version {
+	shares := b.getShares()
+	added := 0.0
+	for _, name := range vv.names() {
+		share := shares[name]
+		if n >= added && n < added+share {
+			return vv[name]
+		}
+		added += share
+	}
+	return vv[DefaultName]
+}
+
+func (b *bandit) getShares() map[string]float64 {
+	return b.shares.Load().(map[string]float64)
+}
+
+// update recalculates the allocation between the versions
+func (b *bandit) update(vv versions) {
+	names := vv.names()
+
+	b.mu.Lock()
+	arms := make([]banditArm, len(names))
+	for i, name := range names {
+		if arm, ok := b.arms[name]; ok {
+			arms[i] = *arm
+		}
+	}
+
+	var raw []float64
+	switch b.config.Strategy {
+	case EpsilonGreedy:
+		raw = epsilonGreedyShares(arms, *b.config.Epsilon)
+	default:
+		raw = b.thompsonShares(arms)
+	}
+	b.mu.Unlock()
+
+	shares := boundShares(raw, names, vv)
+	allocation := make(map[string]float64, len(names))
+	for i, name := range names {
+		allocation[name] = shares[i]
+	}
+	b.shares.Store(allocation)
+}
+
+// thompsonShares estimates the probability that each arm has the best reward rate, b.mu has to be held
+func (b *bandit) thompsonShares(arms []banditArm) []float64 {
+	wins := make([]float64, len(arms))
+	for draw := 0; draw < thompsonDraws; draw++ {
+		best, bestSample := 0, -1.0
+		for i, arm := range arms {
+			sample := betaSample(b.rand, float64(arm.Rewards)+1, float64(failures(arm))+1)
+			if sample > bestSample {
+				best, bestSample = i, sample
+			}
+		}
+		wins[best]++
+	}
+	for i := range wins {
+		wins[i] /= thompsonDraws
+	}
+	return wins
+}
+
+// epsilonGreedyShares gives the arm with the best observed reward rate all of the share except epsilon, which is evenly split
+func epsilonGreedyShares(arms []banditArm, epsilon float64) []float64 {
+	shares := make([]float64, len(arms))
+	best, bestRate := 0, -1.0
+	for i, arm := range arms {
+		shares[i] = epsilon / float64(len(arms))
+		// Smoothed rate so that versions without exposures are neither the best nor the worst
+		rate := (float64(arm.Rewards) + 1) / (float64(arm.Exposures) + 2)
+		if rate > bestRate {
+			best, bestRate = i, rate
+		}
+	}
+	shares[best] += 1 - epsilon
+	return shares
+}
+
+func failures(arm banditArm) uint64 {
+	if arm.Rewards > arm.Exposures {
+		return 0
+	}
+	return arm.Exposures - arm.Rewards
+}
+
+// boundShares normalizes the shares and keeps every version within its MinShare and MaxShare
+// Shares that are outside of the bounds are fixed at the bound, and the rest is split between the other versions
+func boundShares(raw []float64, names []string, vv versions) []float64 {
+	shares := make([]float64, len(raw))
+	fixed := make([]bool, len(raw))
+
+	for iteration := 0; iteration <= len(raw); iteration++ {
+		remaining, freeTotal, free := 1.0, 0.0, 0
+		for i := range raw {
+			if fixed[i] {
+				remaining -= shares[i]
+			} else {
+				freeTotal += raw[i]
+				free++
+			}
+		}
+		if free == 0 {
+			break
+		}
+		for i := range raw {
+			if fixed[i] {
+				continue
+			}
+			if freeTotal > 0 {
+				shares[i] = raw[i] / freeTotal * remaining
+			} else {
+				shares[i] = remaining / float64(free)
+			}
+		}
+
+		changed := false
+		for i, name := range names {
+			if fixed[i] {
+				continue
+			}
+			v := vv[name]
+			if shares[i] < v.MinShare {
+				shares[i], fixed[i], changed = v.MinShare, true, true
+			} else if max := v.maxShare(); shares[i] > max {
+				shares[i], fixed[i], changed = max, true, true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return shares
+}
+
+// betaSample samples the beta distribution, with alpha and beta of at least 1
+func betaSample(r *rand.Rand, alpha, beta float64) float64 {
+	x := gammaSample(r, alpha)
+	y := gammaSample(r, beta)
+	return x / (x + y)
+}
+
+// gammaSample samples the gamma distribution with the shape k >= 1, using the method of Marsaglia and Tsang
+func gammaSample(r *rand.Rand, k float64) float64 {
+	d := k - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := r.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := r.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// maxShare returns the max share of the version in the bandit mode
+func (v *Version) maxShare() float64 {
+	if v.MaxShare == 0 {
+		return 1
+	}
+	return v.MaxShare
+}
+
+// load reads the checkpointed state, a missing file is treated as an empty state
+func (b *bandit) load() error {
+	if b.config.CheckpointFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.config.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := json.Unmarshal(data, &b.arms); err != nil {
+		return fmt.Errorf("could not read the bandit checkpoint %s: %s", b.config.CheckpointFile, err)
+	}
+	b.experiment.logf(b.settings, "loaded the bandit state from %s", b.config.CheckpointFile)
+	return nil
+}
+
+// checkpoint writes the state to the checkpoint file, through a temporary file so that a crash can not leave a partial file
+func (b *bandit) checkpoint() {
+	if b.config.CheckpointFile == "" {
+		return
+	}
+
+	b.mu.Lock()
+	data, err := json.Marshal(b.arms)
+	b.mu.Unlock()
+	if err != nil {
+		b.experiment.logf(b.settings, "could not checkpoint the bandit state: %s", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.config.CheckpointFile), filepath.Base(b.config.CheckpointFile)+".tmp")
+	if err != nil {
+		b.experiment.logf(b.settings, "could not checkpoint the bandit state: %s", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), b.config.CheckpointFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		b.experiment.logf(b.settings, "could not checkpoint the bandit state: %s", err)
+	}
+}
@@ -0,0 +1,296 @@
+package revaboxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoundShares(t *testing.T) {
+	vv, err := newVersions([]Version{
+		{Name: "a", MinShare: 0.1},
+		{Name: "b", MinShare: 0.1},
+		{Name: DefaultName, MaxShare: 0.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := vv.names()
+
+	tests := []struct {
+		name string
+		raw  []float64
+		want []float64
+	}{
+		{name: "within bounds", raw: []float64{0.3, 0.3, 0.4}, want: []float64{0.3, 0.3, 0.4}},
+		{name: "not normalized", raw: []float64{1, 1, 2}, want: []float64{0.25, 0.25, 0.5}},
+		{name: "min share", raw: []float64{1, 0, 0}, want: []float64{0.9, 0.1, 0}},
+		{name: "max share", raw: []float64{0, 0.1, 0.9}, want: []float64{0.1, 0.4, 0.5}},
+		{name: "all zero", raw: []float64{0, 0, 0}, want: []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			real := boundShares(tt.raw, names, vv)
+			for i := range real {
+				if math.Abs(real[i]-tt.want[i]) > 1e-9 {
+					t.Fatalf("boundShares() = %v, want %v", real, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBanditEpsilon(t *testing.T) {
+	zero, half := 0.0, 0.5
+	tests := []struct {
+		name    string
+		epsilon *float64
+		want    float64
+	}{
+		{name: "not set", epsilon: nil, want: 0.1},
+		{name: "greedy", epsilon: &zero, want: 0},
+		{name: "set", epsilon: &half, want: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Bandit{Strategy: EpsilonGreedy, Epsilon: tt.epsilon}
+			if err := b.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if real := *b.withDefaults().Epsilon; real != tt.want {
+				t.Errorf("expected the epsilon %v, got %v", tt.want, real)
+			}
+		})
+	}
+}
+
+func TestBanditStrategies(t *testing.T) {
+	arms := []banditArm{
+		{Exposures: 1000, Rewards: 50},
+		{Exposures: 1000, Rewards: 150},
+		{Exposures: 1000, Rewards: 10},
+	}
+
+	shares := epsilonGreedyShares(arms, 0.3)
+	if math.Abs(shares[0]-0.1) > 1e-9 || math.Abs(shares[1]-0.8) > 1e-9 || math.Abs(shares[2]-0.1) > 1e-9 {
+		t.Errorf("expected the epsilon greedy shares [0.1 0.8 0.1], got %v", shares)
+	}
+
+	b := &bandit{rand: rand.New(rand.NewSource(1))}
+	shares = b.thompsonShares(arms)
+	if shares[1] < 0.95 {
+		t.Errorf("expected thompson sampling to give the best version almost all the share, got %v", shares)
+	}
+	if math.Abs(shares[0]+shares[1]+shares[2]-1) > 1e-9 {
+		t.Errorf("expected the thompson shares to add up to 1, got %v", shares)
+	}
+}
+
+func TestBandit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revaboxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "bandit.json")
+
+	versions := []Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 1,
+		},
+		{
+			Name:     "green",
+			URL:      mustURLParse("http://green.test"),
+			MinShare: 0.1,
+		},
+		{
+			Name: "blue",
+			URL:  mustURLParse("http://blue.test"),
+		},
+	}
+	proxy, err := New(
+		versions,
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"default.test": "default",
+				"green.test":   "green",
+				"blue.test":    "blue",
+			},
+			hostHeader: map[string]http.Header{
+				"green.test": {"Revaboxy-Reward": {"1"}},
+			},
+		}),
+		WithBandit(Bandit{Strategy: EpsilonGreedy, CheckpointFile: checkpoint}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// Users with green as their version rewards it, and the header should not reach the client
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: "green"})
+		proxy.ServeHTTP(rec, req)
+		if rec.Header().Get("Revaboxy-Reward") != "" {
+			t.Fatal("expected the reward header to be removed")
+		}
+	}
+	b := proxy.experiments[0].bandit
+	b.expose("green")
+	b.expose("blue")
+	b.expose("blue")
+	b.update(proxy.experiments[0].getVersions())
+
+	shares := b.getShares()
+	if math.Abs(shares["green"]-(0.9+0.1/3)) > 1e-9 {
+		t.Errorf("expected green to get most of the new users, got %v", shares)
+	}
+	status := proxy.Status()[0]
+	if real, expected := status.Versions[2].Rewards, uint64(10); real != expected {
+		t.Errorf("expected %d rewards in the status, got %d", expected, real)
+	}
+
+	// The state should be loaded from the checkpoint when revaboxy is restarted
+	proxy.Close()
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatal("expected a checkpoint to be written", err)
+	}
+	proxy, err = New(
+		versions,
+		WithBandit(Bandit{Strategy: EpsilonGreedy, CheckpointFile: checkpoint}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+	if real, expected := proxy.experiments[0].bandit.stats("blue").Exposures, uint64(2); real != expected {
+		t.Errorf("expected %d exposures of blue after the restart, got %d", expected, real)
+	}
+	if real := proxy.experiments[0].bandit.getShares()["green"]; math.Abs(real-(0.9+0.1/3)) > 1e-9 {
+		t.Errorf("expected green to still get most of the new users, got %v", real)
+	}
+}
+
+func TestBanditUntracked(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings []Setting
+		url      string
+	}{
+		{
+			name:     "out of scope",
+			settings: []Setting{WithScope(Scope{PathPrefixes: []string{"/checkout"}})},
+			url:      "http://example.com/",
+		},
+		{
+			name:     "forced",
+			settings: []Setting{WithOverride(Override{Secret: "s3cret"})},
+			url:      "http://example.com/?revaboxy=green&revaboxy_secret=s3cret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := append([]Setting{
+				WithTransport(&testRoundTripper{
+					hostAnswer: map[string]string{
+						"default.test": "default",
+						"green.test":   "green",
+					},
+					hostHeader: map[string]http.Header{
+						"default.test": {"Revaboxy-Reward": {"1"}},
+						"green.test":   {"Revaboxy-Reward": {"1"}},
+					},
+				}),
+				WithBandit(Bandit{Strategy: EpsilonGreedy}),
+			}, tt.settings...)
+			proxy, err := New(testVersions(), settings...)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+			defer proxy.Close()
+
+			for i := 0; i < 5; i++ {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+				proxy.ServeHTTP(rec, req)
+				if rec.Header().Get("Revaboxy-Reward") != "" {
+					t.Fatal("expected the reward header to be removed")
+				}
+			}
+
+			// Users that are not part of the experiment should not change the stats of any version
+			for _, name := range []string{DefaultName, "green"} {
+				if real := proxy.experiments[0].bandit.stats(name); real.Exposures != 0 || real.Rewards != 0 {
+					t.Errorf("expected no exposures or rewards of %s, got %+v", name, real)
+				}
+			}
+		})
+	}
+}
+
+func TestBanditUnhealthy(t *testing.T) {
+	versions := testVersions()
+	versions[1].MinShare = 0.9
+	versions[1].HealthCheck = &HealthCheck{Path: "/healthz", Interval: time.Millisecond, UnhealthyThreshold: 1}
+	store := NewMemoryStore(100)
+	proxy, err := New(
+		versions,
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"default.test": "default",
+				"green.test":   "green",
+			},
+			hostStatus: map[string]int{
+				"green.test": http.StatusServiceUnavailable,
+			},
+		}),
+		WithBandit(Bandit{Strategy: EpsilonGreedy}),
+		WithStickiness(Stickiness{Store: store}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	e := proxy.experiments[0]
+	for i := 0; i < 1000 && e.health.healthy("green"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New users that got green are sent to the default version, which they were not assigned
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1000", i)
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if real := e.bandit.stats("green").Exposures; real != 0 {
+		t.Errorf("expected no exposures of the unhealthy version, got %d", real)
+	}
+	if real, expected := uint64(store.Len()), e.bandit.stats(DefaultName).Exposures; real != expected {
+		t.Errorf("expected only the %d users exposed to default to be saved, got %d", expected, real)
+	}
+}
+
+func TestInvalidShares(t *testing.T) {
+	for name, vv := range map[string][]Version{
+		"min above max": {{Name: DefaultName, MinShare: 0.5, MaxShare: 0.4}},
+		"total min":     {{Name: DefaultName, MinShare: 0.6}, {Name: "green", MinShare: 0.6}},
+		"total max":     {{Name: DefaultName, MaxShare: 0.4}, {Name: "green", MaxShare: 0.4}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newVersions(vv); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package revaboxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"net/http"
+)
+
+// BucketingKey describes where a stable identifier of the user, like a logged in user id, can be found in a request
+// When the identifier is present, the version will be selected by hashing it instead of randomly,
+// which makes the same user get the same version on any device
+// The header is checked first, then the cookie and lastly the query parameter
+type BucketingKey struct {
+	// The name of the header that contains the identifier
+	Header string
+	// The name of the cookie that contains the identifier
+	Cookie string
+	// The name of the query parameter that contains the identifier
+	Query string
+	// The salt is hashed together with the identifier, changing it will reshuffle all users
+	// Experiments added with WithExperiment uses their own salt
+	Salt string
+}
+
+// WithBucketingKey sets where a stable identifier is found, which is used to deterministically select version
+// Requests without the identifier will still get a random version
+func WithBucketingKey(key BucketingKey) Setting {
+	return func(s *settings) {
+		s.bucketingKey = &key
+	}
+}
+
+// identifier returns the identifier in the request, or an empty string if none could be found
+func (k *BucketingKey) identifier(req *http.Request) string {
+	if k.Header != "" {
+		if id := req.Header.Get(k.Header); id != "" {
+			return id
+		}
+	}
+	if k.Cookie != "" {
+		if cookie, err := req.Cookie(k.Cookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if k.Query != "" {
+		if id := req.URL.Query().Get(k.Query); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// bucket hashes the salt and identifier into a number in the range [0,1)
+func bucket(salt, id string) float64 {
+	sum := sha256.Sum256([]byte(salt + "\x00" + id))
+	// Use the top 53 bits, the precision of a float64, to get an evenly distributed number
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// selectVersion selects a new version for the request, based on the bucketing key if one is available
+// The salt is the salt of the experiment the version is selected for
+func (s *settings) selectVersion(req *http.Request, vv versions, salt string) *Version {
+	return vv.getVersion(s.bucketValue(req, salt))
+}
+
+// bucketValue returns a number in the range [0,1) for the request, by hashing the bucketing key if one is available
+// and randomly otherwise
+func (s *settings) bucketValue(req *http.Request, salt string) float64 {
+	if s.bucketingKey != nil {
+		if id := s.bucketingKey.identifier(req); id != "" {
+			return bucket(salt, id)
+		}
+	}
+	return rand.Float64()
+}
@@ -0,0 +1,132 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBucketRange(t *testing.T) {
+	for _, id := range []string{"", "a", "user-1", "user-2", "a-very-long-user-identifier"} {
+		n := bucket("salt", id)
+		if n < 0 || n >= 1 {
+			t.Fatalf("expected bucket of %q to be within [0,1), got %v", id, n)
+		}
+		if real := bucket("salt", id); real != n {
+			t.Fatalf("expected bucket of %q to be deterministic, got %v and %v", id, n, real)
+		}
+	}
+}
+
+func TestBucketingKeyIdentifier(t *testing.T) {
+	key := &BucketingKey{
+		Header: "User-Id",
+		Cookie: "user",
+		Query:  "uid",
+	}
+
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		want   string
+	}{
+		{
+			name:   "none",
+			modify: func(req *http.Request) {},
+			want:   "",
+		},
+		{
+			name: "header",
+			modify: func(req *http.Request) {
+				req.Header.Set("User-Id", "from-header")
+				req.AddCookie(&http.Cookie{Name: "user", Value: "from-cookie"})
+			},
+			want: "from-header",
+		},
+		{
+			name: "cookie",
+			modify: func(req *http.Request) {
+				req.AddCookie(&http.Cookie{Name: "user", Value: "from-cookie"})
+			},
+			want: "from-cookie",
+		},
+		{
+			name: "query",
+			modify: func(req *http.Request) {
+				q := req.URL.Query()
+				q.Set("uid", "from-query")
+				req.URL.RawQuery = q.Encode()
+			},
+			want: "from-query",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			tt.modify(req)
+			if real := key.identifier(req); real != tt.want {
+				t.Errorf("identifier() = %q, want %q", real, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketingKeyDistribution(t *testing.T) {
+	vv := versions{}
+	_ = vv.add(Version{Name: DefaultName, Probability: 0.8})
+	_ = vv.add(Version{Name: "test1", Probability: 0.2})
+
+	total := 10000
+	ofName := 0
+	for i := 0; i < total; i++ {
+		if vv.getVersion(bucket("salt", "user-"+strconv.Itoa(i))).Name == "test1" {
+			ofName++
+		}
+	}
+
+	if ratio := float64(ofName) / float64(total); ratio < 0.18 || ratio > 0.22 {
+		t.Fatalf("expected around 20%% to get test1, got %v", ratio)
+	}
+}
+
+func Test_WithBucketingKey(t *testing.T) {
+	rt := &savingRoundtripper{}
+
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://example.com"),
+				Probability: 0.5,
+			},
+			{
+				Name:        "test",
+				URL:         mustURLParse("http://example.com"),
+				Probability: 0.5,
+			},
+		},
+		WithBucketingKey(BucketingKey{Header: "User-Id", Salt: "experiment"}),
+		WithTransport(rt),
+	)
+	if err != nil {
+		t.Fatal("should not error when creating revaboxy")
+	}
+
+	// Requests without any cookie but with the same user id should always get the same version
+	var first string
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set("User-Id", "user-1234")
+		proxy.ServeHTTP(rec, req)
+
+		name := rt.req.Header.Get("Revaboxy-Name")
+		if first == "" {
+			first = name
+		}
+		if name != first {
+			t.Fatalf("expected the same version for the same user, got %s and %s", first, name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package revaboxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// WithCookieSigningKey makes revaboxy sign the cookie that contains the selected version with HMAC-SHA256
+// so that clients can not select their own version by changing the cookie.
+// New cookies are always signed with the key. Cookies are accepted if they are signed with the key
+// or any of the verification keys, which makes it possible to rotate keys without reassigning all users.
+// Unsigned or tampered cookies will be treated as if the user has not been assigned a version yet
+func WithCookieSigningKey(key []byte, verificationKeys ...[]byte) Setting {
+	return func(s *settings) {
+		s.cookieSigner = &cookieSigner{
+			key:              key,
+			verificationKeys: verificationKeys,
+		}
+	}
+}
+
+// cookieSigner signs and verifies cookie values, the signed value has the format "value.signature"
+type cookieSigner struct {
+	key              []byte
+	verificationKeys [][]byte
+}
+
+func (cs *cookieSigner) sign(value string) string {
+	return value + "." + signature(cs.key, value)
+}
+
+// verify returns the unsigned value if the signature is valid
+func (cs *cookieSigner) verify(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value, sig := signed[:i], signed[i+1:]
+
+	if hmac.Equal([]byte(sig), []byte(signature(cs.key, value))) {
+		return value, true
+	}
+	for _, key := range cs.verificationKeys {
+		if hmac.Equal([]byte(sig), []byte(signature(key, value))) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func signature(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeCookieValue returns the value that should be stored in the cookie for a version name
+func (s *settings) encodeCookieValue(name string) string {
+	if s.cookieSigner == nil {
+		return name
+	}
+	return s.cookieSigner.sign(name)
+}
+
+// decodeCookieValue returns the version name stored in a cookie value, ok is false if the value could not be trusted
+func (s *settings) decodeCookieValue(value string) (name string, ok bool) {
+	if s.cookieSigner == nil {
+		return value, true
+	}
+	return s.cookieSigner.verify(value)
+}
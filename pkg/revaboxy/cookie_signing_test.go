@@ -0,0 +1,115 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookieSigner(t *testing.T) {
+	oldSigner := &cookieSigner{key: []byte("old-key")}
+	signer := &cookieSigner{
+		key:              []byte("new-key"),
+		verificationKeys: [][]byte{[]byte("old-key")},
+	}
+
+	tests := []struct {
+		name      string
+		signed    string
+		wantValue string
+		wantOK    bool
+	}{
+		{
+			name:      "signed",
+			signed:    signer.sign("green"),
+			wantValue: "green",
+			wantOK:    true,
+		},
+		{
+			name:      "signed with verification key",
+			signed:    oldSigner.sign("green"),
+			wantValue: "green",
+			wantOK:    true,
+		},
+		{
+			name:   "unsigned",
+			signed: "green",
+			wantOK: false,
+		},
+		{
+			name:   "tampered",
+			signed: "blue" + signer.sign("green")[len("green"):],
+			wantOK: false,
+		},
+		{
+			name:   "unknown key",
+			signed: (&cookieSigner{key: []byte("other-key")}).sign("green"),
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok := signer.verify(tt.signed)
+			if ok != tt.wantOK {
+				t.Fatalf("verify() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if value != tt.wantValue {
+				t.Fatalf("verify() value = %q, want %q", value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func Test_WithCookieSigningKey(t *testing.T) {
+	rt := &savingRoundtripper{}
+
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://example.com"),
+				Probability: 1,
+			},
+			{
+				Name:        "test",
+				URL:         mustURLParse("http://example.com"),
+				Probability: 0,
+			},
+		},
+		WithCookieSigningKey([]byte("key")),
+		WithTransport(rt),
+	)
+	if err != nil {
+		t.Fatal("should not error when creating revaboxy")
+	}
+
+	// A client selecting its own version should be treated as a new user
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: "test"})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.Header.Get("Revaboxy-Name"), DefaultName; real != expected {
+		t.Fatalf(`expected version "%s", got "%s"`, expected, real)
+	}
+	cookies := rec.Result().Cookies()
+	if real, expected := len(cookies), 1; real != expected {
+		t.Fatalf(`expected %d cookies, got %d`, expected, real)
+	}
+	if real, expected := cookies[0].Value, (&cookieSigner{key: []byte("key")}).sign(DefaultName); real != expected {
+		t.Fatalf(`expected cookie value "%s", got "%s"`, expected, real)
+	}
+
+	// A correctly signed cookie should be used
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: (&cookieSigner{key: []byte("key")}).sign("test")})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.Header.Get("Revaboxy-Name"), "test"; real != expected {
+		t.Fatalf(`expected version "%s", got "%s"`, expected, real)
+	}
+	if real, expected := len(rec.Result().Cookies()), 0; real != expected {
+		t.Fatalf(`expected %d cookies, got %d`, expected, real)
+	}
+}
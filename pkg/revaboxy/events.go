@@ -0,0 +1,251 @@
+package revaboxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of events
+const (
+	// EventAssignment is a request that was assigned a version of an experiment
+	EventAssignment = "assignment"
+	// EventGoal is a goal reached by a user of a version
+	EventGoal = "goal"
+)
+
+// How the version of an EventAssignment was assigned
+const (
+	// AssignmentNew is a new user, or a user whose cookie could not be used, that was assigned a version
+	AssignmentNew = "new"
+	// AssignmentSticky is a user that used the version stored in the cookie
+	AssignmentSticky = "sticky"
+	// AssignmentOverride is a request that used a version forced with an override
+	AssignmentOverride = "override"
+	// AssignmentPinned is a user that is pinned to the version by an allowlist
+	AssignmentPinned = "pinned"
+	// AssignmentDefault is a request that got the default version since it was out of scope, not targeted,
+	// or the experiment had not started
+	AssignmentDefault = "default"
+	// AssignmentConcluded is a request that got the winner of an ended experiment
+	AssignmentConcluded = "concluded"
+	// AssignmentFailover is a request to the version that was unhealthy or failed, and was sent to the default version instead
+	AssignmentFailover = "failover"
+)
+
+// Event is a record of something that happened in an experiment
+type Event struct {
+	Time time.Time `json:"time"`
+	// The type of the event, EventAssignment or EventGoal
+	Type string `json:"type"`
+	// The name of the experiment, empty for the main experiment
+	Experiment string `json:"experiment,omitempty"`
+	Version    string `json:"version"`
+	// How the version was assigned for EventAssignment, one of the Assignment constants
+	Assignment string `json:"assignment,omitempty"`
+	// The path of the request
+	Path string `json:"path,omitempty"`
+	// The hashed identifier of the user, from the bucketing key if it is available, and from the ip and User-Agent otherwise
+	Visitor string `json:"visitor,omitempty"`
+	// The name and value of the goal of EventGoal
+	Goal  string  `json:"goal,omitempty"`
+	Value float64 `json:"value,omitempty"`
+	// If the user had already reached the goal of EventGoal with the version, so that it is not a new conversion
+	Repeat bool `json:"repeat,omitempty"`
+}
+
+// EventSink receives the events of all experiments
+// The events are written from a single goroutine, off the request path, so the sink may block
+type EventSink interface {
+	WriteEvent(e Event) error
+	// Close writes any buffered events and releases the resources of the sink
+	Close() error
+}
+
+// flusher is implemented by sinks that buffer events, Flush is called when there are no more events waiting
+type flusher interface {
+	Flush() error
+}
+
+// EventLog records every assignment and goal to a sink, e.g. for offline analysis
+// The events are buffered in memory, and dropped if the buffer is full so that requests are never blocked.
+// The dropped events are counted in MetricEventsDropped
+type EventLog struct {
+	// The sink the events are written to. A RotatingFile created from File is used if it is not set
+	Sink EventSink
+	File EventFile
+	// The number of events that can be waiting to be written, defaults to 10000
+	BufferSize int
+}
+
+// WithEventLog records every assignment and goal of all experiments
+func WithEventLog(l EventLog) Setting {
+	return func(s *settings) {
+		if l.BufferSize <= 0 {
+			l.BufferSize = 10000
+		}
+		s.eventLog = &l
+	}
+}
+
+// eventWriter writes events to the sink of the event log from a single goroutine
+type eventWriter struct {
+	// The number of events that has been dropped, used atomically
+	dropped uint64
+
+	settings *settings
+	config   EventLog
+	sink     EventSink
+	events   chan Event
+
+	// closed is guarded by mu, which is held while sending to make sure events are never sent on a closed channel
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newEventWriter(s *settings, config EventLog) (*eventWriter, error) {
+	sink := config.Sink
+	if sink == nil {
+		file, err := NewRotatingFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		sink = file
+	}
+
+	w := &eventWriter{
+		settings: s,
+		config:   config,
+		sink:     sink,
+		events:   make(chan Event, config.BufferSize),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func (w *eventWriter) run() {
+	defer w.wg.Done()
+	f, canFlush := w.sink.(flusher)
+	for e := range w.events {
+		if err := w.sink.WriteEvent(e); err != nil {
+			w.settings.logger.Printf("could not write the %s event: %s", e.Type, err)
+		}
+		if canFlush && len(w.events) == 0 {
+			if err := f.Flush(); err != nil {
+				w.settings.logger.Printf("could not flush the events: %s", err)
+			}
+		}
+	}
+}
+
+// record queues the event to be written, it is dropped if the buffer is full
+func (w *eventWriter) record(e Event) {
+	if w == nil {
+		return
+	}
+	e.Time = time.Now()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+		if atomic.AddUint64(&w.dropped, 1) == 1 {
+			w.settings.logger.Printf("the event buffer is full, dropping events")
+		}
+		w.settings.metrics.IncCounter(MetricEventsDropped, map[string]string{})
+	}
+}
+
+// close writes all waiting events and closes the sink
+func (w *eventWriter) close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.events)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	return w.sink.Close()
+}
+
+// recordAssignments records the assignments of all experiments of a request
+func (w *eventWriter) recordAssignments(req *http.Request, state *requestState) {
+	if w == nil {
+		return
+	}
+	visitor := w.settings.visitor(req)
+	for _, a := range state.assignments {
+		version := a.version.Name
+		if a.kind == AssignmentFailover {
+			version = a.failed
+		}
+		w.record(Event{
+			Type:       EventAssignment,
+			Experiment: a.experiment.name,
+			Version:    version,
+			Assignment: a.kind,
+			Path:       state.url.Path,
+			Visitor:    visitor,
+		})
+	}
+}
+
+// recordFailover records that the request to the version of the routing experiment failed, and is sent to the default version instead
+func (w *eventWriter) recordFailover(req *http.Request, state *requestState) {
+	if w == nil {
+		return
+	}
+	w.record(Event{
+		Type:       EventAssignment,
+		Experiment: state.route.experiment.name,
+		Version:    state.route.version.Name,
+		Assignment: AssignmentFailover,
+		Path:       state.url.Path,
+		Visitor:    w.settings.visitor(req),
+	})
+}
+
+// DroppedEvents returns the number of events that has been dropped since the buffer of the event log was full
+func (revaboxy *Revaboxy) DroppedEvents() uint64 {
+	if revaboxy.settings.events == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&revaboxy.settings.events.dropped)
+}
+
+// ReadEvents reads events in the JSONL format written by RotatingFile, and calls fn with each of them
+func ReadEvents(r io.Reader, fn func(Event) error) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
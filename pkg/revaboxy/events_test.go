@@ -0,0 +1,139 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type memorySink struct {
+	mu     sync.Mutex
+	events []Event
+	closed bool
+}
+
+func (s *memorySink) WriteEvent(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// blockingSink blocks all writes until it is closed
+type blockingSink struct {
+	unblock chan struct{}
+}
+
+func (s *blockingSink) WriteEvent(e Event) error {
+	<-s.unblock
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestEventLog(t *testing.T) {
+	sink := &memorySink{}
+	proxy, err := New(
+		[]Version{
+			{Name: DefaultName, URL: mustURLParse("http://default.test")},
+			{Name: "green", URL: mustURLParse("http://green.test"), Probability: 1},
+		},
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"default.test": "default-data",
+			},
+		}),
+		WithOverride(Override{Secret: "qa"}),
+		WithEventLog(EventLog{Sink: sink}),
+		WithVisitorSalt("salt"),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	requests := []struct {
+		url    string
+		cookie string
+	}{
+		// green can not be reached, so the request fails over to the default version
+		{url: "http://example.com/new"},
+		{url: "http://example.com/sticky", cookie: DefaultName},
+		{url: "http://example.com/forced?revaboxy=default&revaboxy_secret=qa"},
+	}
+	for _, r := range requests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, r.url, nil)
+		req.RemoteAddr = "192.168.1.10:1234"
+		if r.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: r.cookie})
+		}
+		proxy.ServeHTTP(rec, req)
+	}
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{Type: EventAssignment, Version: "green", Assignment: AssignmentNew, Path: "/new"},
+		{Type: EventAssignment, Version: "green", Assignment: AssignmentFailover, Path: "/new"},
+		{Type: EventAssignment, Version: DefaultName, Assignment: AssignmentSticky, Path: "/sticky"},
+		{Type: EventAssignment, Version: DefaultName, Assignment: AssignmentOverride, Path: "/forced"},
+	}
+	if !sink.closed {
+		t.Error("expected the sink to be closed")
+	}
+	if real := len(sink.events); real != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), real, sink.events)
+	}
+	visitor := sink.events[0].Visitor
+	for i, e := range sink.events {
+		if e.Time.IsZero() || e.Visitor != visitor || len(visitor) != 32 {
+			t.Errorf("expected a time and the same hashed visitor of the requests, got %+v", e)
+		}
+		e.Time, e.Visitor = expected[i].Time, expected[i].Visitor
+		if e != expected[i] {
+			t.Errorf("expected the event %+v, got %+v", expected[i], e)
+		}
+	}
+}
+
+func TestEventLogDrops(t *testing.T) {
+	m := newTestMetrics()
+	sink := &blockingSink{unblock: make(chan struct{})}
+	proxy, err := New(
+		[]Version{{Name: DefaultName, URL: mustURLParse("http://default.test")}},
+		WithTransport(&savingRoundtripper{}),
+		WithMetrics(m),
+		WithEventLog(EventLog{Sink: sink, BufferSize: 2}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// One event is being written, two are buffered, and the rest are dropped
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		proxy.ServeHTTP(rec, req)
+	}
+	dropped := proxy.DroppedEvents()
+	if dropped < 7 || dropped > 8 {
+		t.Errorf("expected 7 or 8 dropped events, got %d", dropped)
+	}
+	close(sink.unblock)
+	proxy.Close()
+
+	if real, expected := m.counters["revaboxy_events_dropped_total{}"], int(dropped); real != expected {
+		t.Errorf("expected %d dropped events to be counted, got %d", expected, real)
+	}
+}
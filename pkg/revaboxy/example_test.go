@@ -14,14 +14,14 @@ func ExampleNew() {
 
 	rp, err := revaboxy.New([]revaboxy.Version{
 		{
-			revaboxy.DefaultName,
-			defaultURL,
-			0.7,
+			Name:        revaboxy.DefaultName,
+			URL:         defaultURL,
+			Probability: 0.7,
 		},
 		{
-			"green-background",
-			greenBackgroundURL,
-			0.3,
+			Name:        "green-background",
+			URL:         greenBackgroundURL,
+			Probability: 0.3,
 		},
 	})
 	if err != nil {
@@ -30,3 +30,55 @@ func ExampleNew() {
 
 	log.Fatal(http.ListenAndServe(":8080", rp))
 }
+
+func ExampleVersion_handler() {
+	oldCheckout := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("old checkout"))
+	})
+	newCheckout := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new checkout"))
+	})
+
+	rp, err := revaboxy.New([]revaboxy.Version{
+		{
+			Name:    revaboxy.DefaultName,
+			Handler: oldCheckout,
+		},
+		{
+			Name:        "new-checkout",
+			Handler:     newCheckout,
+			Probability: 0.5,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(http.ListenAndServe(":8080", rp))
+}
+
+func ExampleRevaboxy_Middleware() {
+	ab, err := revaboxy.New([]revaboxy.Version{
+		{
+			Name:        revaboxy.DefaultName,
+			Probability: 0.5,
+		},
+		{
+			Name:        "new-checkout",
+			Probability: 0.5,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if revaboxy.VersionFromContext(r.Context()).Name == "new-checkout" {
+			w.Write([]byte("new checkout"))
+			return
+		}
+		w.Write([]byte("old checkout"))
+	})
+
+	log.Fatal(http.ListenAndServe(":8080", ab.Middleware(handler)))
+}
@@ -0,0 +1,463 @@
+package revaboxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Experiment is an A/B test that runs at the same time as, and independently of, the main experiment created with New
+// Every experiment has its own versions, cookie and header. All assignments are forwarded to the downstream service,
+// but the request is only sent to the version of one experiment. The first experiment added with WithExperiment
+// whose scope matches the request is used, and the main experiment is used if none of them matches
+type Experiment struct {
+	// The name of the experiment, which has to be unique. The name is appended to the cookie and header names
+	// of the experiment, e.g. "revaboxy-name-checkout" and "Revaboxy-Name-Checkout", so it has to be a token as defined in RFC 7230
+	Name string
+	// The versions of the experiment, one of them has to be named DefaultName
+	Versions []Version
+	// The salt used together with the bucketing key, defaults to the name of the experiment
+	Salt string
+	// The requests that the experiment applies to
+	Scope Scope
+	// Optional time that the experiment is running
+	Window *Window
+	// Optional adaptive allocation of new users, instead of by the probabilities of the versions
+	Bandit *Bandit
+	// Optional targeting that requests in the scope needs to match to be assigned a version
+	Targeting *Targeting
+}
+
+// WithExperiment adds an experiment that is run at the same time as the main experiment
+func WithExperiment(e Experiment) Setting {
+	return func(s *settings) {
+		s.experiments = append(s.experiments, e)
+	}
+}
+
+// validate checks the name and scope of the experiment, names are the names of the previously added experiments
+func (e *Experiment) validate(names map[string]bool) error {
+	if e.Name == "" {
+		return fmt.Errorf("all experiments needs to have a name")
+	}
+	if !isToken(e.Name) {
+		return fmt.Errorf("the experiment name \"%s\" can only contain letters, digits and !#$%%&'*+-.^_`|~, since it is used in cookie and header names", e.Name)
+	}
+	if names[e.Name] {
+		return fmt.Errorf("dublicate experiment name \"%s\"", e.Name)
+	}
+	if err := e.Scope.validate(); err != nil {
+		return fmt.Errorf("experiment %s: %s", e.Name, err)
+	}
+	if e.Window != nil {
+		if err := e.Window.validate(); err != nil {
+			return fmt.Errorf("experiment %s: %s", e.Name, err)
+		}
+	}
+	return nil
+}
+
+// isToken checks if s is a token as defined in RFC 7230, which are the characters allowed in header and cookie names
+// Tokens can not contain ":", which separates the name of the experiment in overrides and in the keys of the assignment store
+func isToken(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// experiment is the running state of an experiment
+type experiment struct {
+	// The phase of the window that the experiment was in at the last request, used atomically
+	phase int32
+
+	// The name of the experiment, empty for the main experiment
+	name       string
+	cookieName string
+	headerName string
+	salt       string
+	// The cookie with the version forced by a persisted override
+	overrideCookieName string
+	// The requests the experiment applies to, nil if it applies to all requests
+	scope *Scope
+	// The requests that are eligible for a version, nil if all requests are
+	targeting *Targeting
+	// The time that the experiment is running, nil if it is always running
+	window *Window
+	// The bandit mode of the experiment, nil if it is not used
+	bandit *bandit
+	// The goals reached by the users of each version
+	goals goalCounter
+	// The sample ratio check of the experiment, nil if it is not used
+	sampleRatio *sampleRatio
+
+	// The currently used versions
+	versions atomic.Value
+	health   *healthChecker
+}
+
+func newExperiment(s *settings, name string, vv []Version, window *Window, banditConfig *Bandit) (*experiment, error) {
+	e := &experiment{
+		name:       name,
+		cookieName: s.cookieName,
+		headerName: s.headerName,
+		window:     window,
+		phase:      int32(window.phaseAt(time.Now())),
+	}
+	if s.bucketingKey != nil {
+		e.salt = s.bucketingKey.Salt
+	}
+	e.overrideCookieName = s.cookieName + overrideCookieSuffix
+	if name != "" {
+		e.cookieName = experimentCookieName(s, name)
+		e.headerName = experimentHeaderName(s, name)
+		e.overrideCookieName += "-" + name
+		e.salt = name
+	}
+	e.health = newHealthChecker(s, name, e.headerName)
+	if banditConfig != nil {
+		b, err := newBandit(s, e, *banditConfig)
+		if err != nil {
+			return nil, err
+		}
+		e.bandit = b
+	}
+
+	if err := e.update(vv); err != nil {
+		return nil, err
+	}
+	if e.bandit != nil {
+		e.bandit.start()
+	}
+	if s.sampleRatioCheck != nil {
+		e.sampleRatio = newSampleRatio(s, e, *s.sampleRatioCheck)
+		e.sampleRatio.start()
+	}
+	return e, nil
+}
+
+func experimentCookieName(s *settings, name string) string {
+	return s.cookieName + "-" + name
+}
+
+func experimentHeaderName(s *settings, name string) string {
+	return http.CanonicalHeaderKey(s.headerName + "-" + name)
+}
+
+// update validates and replaces the versions of the experiment
+func (e *experiment) update(vv []Version) error {
+	versions, err := e.newVersions(vv)
+	if err != nil {
+		return err
+	}
+	e.apply(versions)
+	return nil
+}
+
+// newVersions validates the versions for the experiment without applying them
+func (e *experiment) newVersions(vv []Version) (versions, error) {
+	versions, err := newVersions(vv)
+	if err == nil && e.window != nil && versions[e.window.winner()] == nil {
+		err = fmt.Errorf("the winner %s does not exist", e.window.winner())
+	}
+	if err != nil {
+		if e.name != "" {
+			return nil, fmt.Errorf("experiment %s: %s", e.name, err)
+		}
+		return nil, err
+	}
+	return versions, nil
+}
+
+// apply replaces the versions of the experiment with versions that have been validated
+func (e *experiment) apply(versions versions) {
+	e.versions.Store(versions)
+	e.health.update(versions)
+	if e.bandit != nil {
+		e.bandit.update(versions)
+	}
+}
+
+func (e *experiment) getVersions() versions {
+	return e.versions.Load().(versions)
+}
+
+// logf logs with the name of the experiment as prefix, unless it is the main experiment
+func (e *experiment) logf(s *settings, format string, args ...interface{}) {
+	if e.name != "" {
+		format = "experiment %s: " + format
+		args = append([]interface{}{e.name}, args...)
+	}
+	s.logger.Printf(format, args...)
+}
+
+// labels returns the metric labels of a version in the experiment
+func (e *experiment) labels(version string) map[string]string {
+	labels := versionLabels(version)
+	if e.name != "" {
+		labels[LabelExperiment] = e.name
+	}
+	return labels
+}
+
+// inScope checks if the experiment applies to the request
+func (e *experiment) inScope(req *http.Request) bool {
+	return e.scope == nil || e.scope.matches(req)
+}
+
+// assignInScope selects the version used for a request in the scope of the experiment
+// A forced version is used ahead of allowlists, which are used ahead of the window, the targeting and the cookie
+func (e *experiment) assignInScope(s *settings, req *http.Request, forced *overrides) *assignment {
+	if name, ok := forced.version(e.name); ok {
+		if a := e.force(s, name, forced.persist); a != nil {
+			return a
+		}
+	} else if name, ok := e.persisted(s, req); ok {
+		if a := e.force(s, name, false); a != nil {
+			return a
+		}
+	}
+	if a := e.pin(s, req); a != nil {
+		e.avoidUnhealthy(s, a)
+		return a
+	}
+	switch e.currentPhase(s) {
+	case phaseScheduled:
+		return e.useDefault(s, "the experiment has not started")
+	case phaseEnded:
+		a := e.conclude(s, req)
+		e.avoidUnhealthy(s, a)
+		return a
+	}
+	if !e.eligible(req) {
+		return e.useDefault(s, "request is not targeted")
+	}
+	a := e.assign(s, req)
+	e.avoidUnhealthy(s, a)
+	if a.kind == AssignmentNew {
+		e.addUser(s, a.version.Name)
+	}
+	return a
+}
+
+// force uses a version forced by an override, nil is returned if the version does not exist
+// The override cookie is only set if the override should be persisted. The user is not tracked either way,
+// so that forced versions are not counted in the experiment
+func (e *experiment) force(s *settings, name string, persist bool) *assignment {
+	versions := e.getVersions()
+	version, ok := versions[name]
+	if !ok {
+		e.logf(s, "could not force the unknown version %s", name)
+		return nil
+	}
+
+	e.logf(s, "using forced version %s", name)
+	s.metrics.IncCounter(MetricOverrides, e.labels(name))
+	return &assignment{
+		experiment: e,
+		versions:   versions,
+		version:    version,
+		setCookie:  persist,
+		kind:       AssignmentOverride,
+	}
+}
+
+// persisted returns the version forced by an override that was persisted in the override cookie, ok is false if there is none
+// The regular cookie is never used for it, since the user would then be counted as if it had been assigned the version
+func (e *experiment) persisted(s *settings, req *http.Request) (name string, ok bool) {
+	if s.override == nil {
+		return "", false
+	}
+	cookie, _ := req.Cookie(e.overrideCookieName)
+	if cookie == nil {
+		return "", false
+	}
+	return s.decodeCookieValue(cookie.Value)
+}
+
+// pin uses the version that the request is pinned to by an allowlist, nil is returned if it is not pinned
+func (e *experiment) pin(s *settings, req *http.Request) *assignment {
+	versions := e.getVersions()
+	version := versions.pinned(req)
+	if version == nil {
+		return nil
+	}
+
+	e.logf(s, "pinned to version %s by the allowlist", version.Name)
+	s.metrics.IncCounter(MetricPinned, e.labels(version.Name))
+	return &assignment{
+		experiment: e,
+		versions:   versions,
+		version:    version,
+		kind:       AssignmentPinned,
+	}
+}
+
+// assign selects the version of the experiment used for a request. If the user has already been assigned a version, that one will be used.
+// Otherwise the version in the assignment store is used, or a new version will be assigned to the user, randomly or based on the bucketing key
+func (e *experiment) assign(s *settings, req *http.Request) *assignment {
+	a := &assignment{
+		experiment: e,
+		versions:   e.getVersions(),
+		tracked:    true,
+		kind:       AssignmentNew,
+	}
+
+	cookie, _ := req.Cookie(e.cookieName)
+	if cookie == nil {
+		if a.restore(s, req) {
+			return a
+		}
+		e.logf(s, "new request, using a new version")
+		a.assignNew(s, req)
+		s.metrics.IncCounter(MetricAssignments, e.labels(a.version.Name))
+		return a
+	}
+
+	name, ok := s.decodeCookieValue(cookie.Value)
+	if !ok {
+		if a.restore(s, req) {
+			return a
+		}
+		e.logf(s, "could not verify the signature of cookie %s and using a new version instead", cookie.Value)
+		a.assignNew(s, req)
+		s.metrics.IncCounter(MetricInvalidCookieReassignments, e.labels(a.version.Name))
+		return a
+	}
+
+	version, ok := a.versions[name]
+	if !ok {
+		if a.restore(s, req) {
+			return a
+		}
+		e.logf(s, "could not use previous version %s and using a new version instead", cookie.Value)
+		a.assignNew(s, req)
+		s.metrics.IncCounter(MetricInvalidCookieReassignments, e.labels(a.version.Name))
+		return a
+	}
+
+	e.logf(s, "using previous used version %s", version.Name)
+	a.version = version
+	a.kind = AssignmentSticky
+	s.metrics.IncCounter(MetricStickyHits, e.labels(version.Name))
+	return a
+}
+
+// eligible checks if the request matches the targeting of the experiment
+func (e *experiment) eligible(req *http.Request) bool {
+	return e.targeting == nil || e.targeting.match(req)
+}
+
+// useDefault returns the default version, without setting a cookie
+func (e *experiment) useDefault(s *settings, reason string) *assignment {
+	e.logf(s, "%s, using default", reason)
+	versions := e.getVersions()
+	return &assignment{
+		experiment: e,
+		versions:   versions,
+		version:    versions[DefaultName],
+		kind:       AssignmentDefault,
+	}
+}
+
+// existing returns the version the user has already been assigned in the cookie, without assigning a new one
+// A version forced by a persisted override is used ahead of it, but is not tracked
+// The assignment store is not used, since it is only checked before a new version would be selected
+// It is used to forward the assignments of experiments that does not apply to the request
+func (e *experiment) existing(s *settings, req *http.Request) *assignment {
+	a := &assignment{
+		experiment: e,
+		versions:   e.getVersions(),
+		tracked:    true,
+		kind:       AssignmentSticky,
+	}
+	if name, ok := e.persisted(s, req); ok && a.versions[name] != nil {
+		a.version = a.versions[name]
+		a.tracked = false
+		a.kind = AssignmentOverride
+		return a
+	}
+	if cookie, _ := req.Cookie(e.cookieName); cookie != nil {
+		if name, ok := s.decodeCookieValue(cookie.Value); ok {
+			a.version = a.versions[name]
+		}
+	}
+	if a.version == nil {
+		return nil
+	}
+	return a
+}
+
+// avoidUnhealthy uses the default version if the assigned version is unhealthy
+// The user will get back to the assigned version when it has recovered
+func (e *experiment) avoidUnhealthy(s *settings, a *assignment) {
+	name := a.version.Name
+	if name == DefaultName || e.health.healthy(name) {
+		return
+	}
+
+	e.logf(s, "version %s is unhealthy, using default instead", name)
+	s.metrics.IncCounter(MetricFailovers, e.labels(name))
+	a.failed = name
+	a.version = a.versions[DefaultName]
+	a.setCookie = false
+	a.tracked = false
+	a.kind = AssignmentFailover
+}
+
+// assignment is the version of one experiment used for a request
+type assignment struct {
+	experiment *experiment
+	// The versions that was used when the request started, so that the same versions are used through the request
+	versions versions
+	// The assigned version
+	version *Version
+	// If the user has not got a valid cookie and a new one should be set
+	setCookie bool
+	// If the user is part of the experiment with the version, and goals should be counted for it
+	tracked bool
+	// How the version was assigned, one of the Assignment constants, and the version that could not be used for AssignmentFailover
+	kind   string
+	failed string
+}
+
+// assignNew assigns a new version to the user, and saves it in the assignment store
+// If the version is unhealthy the request is sent to the default version instead, and nothing is exposed or saved
+func (a *assignment) assignNew(s *settings, req *http.Request) {
+	b := a.experiment.bandit
+	if b != nil {
+		a.version = b.pick(a.versions, s.bucketValue(req, a.experiment.salt))
+	} else {
+		a.version = s.selectVersion(req, a.versions, a.experiment.salt)
+	}
+	a.setCookie = true
+
+	a.experiment.avoidUnhealthy(s, a)
+	if !a.tracked {
+		return
+	}
+	if b != nil {
+		b.expose(a.version.Name)
+	}
+	a.experiment.save(s, req, a.version.Name)
+}
+
+// restore uses the version saved for the user in the assignment store, false is returned if there is none
+// The cookie is set again, since the user did not have a valid one
+func (a *assignment) restore(s *settings, req *http.Request) bool {
+	version := a.experiment.stored(s, req, a.versions)
+	if version == nil {
+		return false
+	}
+
+	a.experiment.logf(s, "using version %s from the assignment store", version.Name)
+	a.version = version
+	a.setCookie = true
+	a.kind = AssignmentSticky
+	s.metrics.IncCounter(MetricStoreHits, a.experiment.labels(version.Name))
+	return true
+}
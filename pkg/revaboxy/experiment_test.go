@@ -0,0 +1,304 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExperiments(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		cookies      map[string]string
+		wantHost     string
+		wantMain     string
+		wantCheckout string
+		wantCookies  map[string]string
+	}{
+		{
+			name:         "experiment",
+			path:         "/checkout/pay",
+			wantHost:     "checkout-one-click.test",
+			wantMain:     "green",
+			wantCheckout: "one-click",
+			wantCookies:  map[string]string{"revaboxy-name": "green", "revaboxy-name-checkout": "one-click"},
+		},
+		{
+			name:        "out of scope",
+			path:        "/",
+			wantHost:    "green.test",
+			wantMain:    "green",
+			wantCookies: map[string]string{"revaboxy-name": "green"},
+		},
+		{
+			name:         "existing assignments are forwarded",
+			path:         "/",
+			cookies:      map[string]string{"revaboxy-name": "green", "revaboxy-name-checkout": DefaultName},
+			wantHost:     "green.test",
+			wantMain:     "green",
+			wantCheckout: DefaultName,
+			wantCookies:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &savingRoundtripper{}
+			proxy, err := New(testVersions(), WithTransport(rt), WithExperiment(testExperiment()))
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			req.Header.Set("Revaboxy-Name-Checkout", "spoofed")
+			for name, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			proxy.ServeHTTP(rec, req)
+
+			if real := rt.req.URL.Host; real != tt.wantHost {
+				t.Errorf("expected the request to be sent to %s, got %s", tt.wantHost, real)
+			}
+			if real := rt.req.Header.Get("Revaboxy-Name"); real != tt.wantMain {
+				t.Errorf("expected main version %s, got %s", tt.wantMain, real)
+			}
+			if real := strings.Join(rt.req.Header.Values("Revaboxy-Name-Checkout"), ","); real != tt.wantCheckout {
+				t.Errorf("expected checkout version %q, got %q", tt.wantCheckout, real)
+			}
+
+			cookies := map[string]string{}
+			for _, c := range rec.Result().Cookies() {
+				cookies[c.Name] = c.Value
+			}
+			if !reflect.DeepEqual(cookies, tt.wantCookies) {
+				t.Errorf("expected the cookies %v, got %v", tt.wantCookies, cookies)
+			}
+		})
+	}
+}
+
+func TestExperimentsInvalid(t *testing.T) {
+	valid := []Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 1,
+		},
+	}
+
+	tests := []struct {
+		name        string
+		experiments []Experiment
+	}{
+		{
+			name:        "no name",
+			experiments: []Experiment{{Versions: valid}},
+		},
+		{
+			name:        "duplicate name",
+			experiments: []Experiment{{Name: "a", Versions: valid}, {Name: "a", Versions: valid}},
+		},
+		{
+			name: "no default",
+			experiments: []Experiment{{Name: "a", Versions: []Version{
+				{
+					Name:        "green",
+					URL:         mustURLParse("http://green.test"),
+					Probability: 1,
+				},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var settings []Setting
+			for _, e := range tt.experiments {
+				settings = append(settings, WithExperiment(e))
+			}
+			if _, err := New(valid, settings...); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestExperimentNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "checkout"},
+		{name: "one_click.v2"},
+		{name: "Search-2020"},
+		{name: "", wantErr: true},
+		{name: "new checkout", wantErr: true},
+		{name: "checkout:v2", wantErr: true},
+		{name: "checkout;v2", wantErr: true},
+		{name: "kassa-ö", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testExperiment()
+			e.Name = tt.name
+			_, err := New(testVersions(), WithExperiment(e))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected an error: %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestUpdateExperimentVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		experiment string
+		wantErr    bool
+		wantHost   string
+	}{
+		{
+			name:       "experiment",
+			experiment: "checkout",
+			wantHost:   "checkout.test",
+		},
+		{
+			name:       "unknown experiment",
+			experiment: "unknown",
+			wantErr:    true,
+			wantHost:   "checkout-one-click.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &savingRoundtripper{}
+			proxy, err := New(testVersions(), WithTransport(rt), WithExperiment(testExperiment()))
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+
+			err = proxy.UpdateExperimentVersions(tt.experiment, []Version{
+				{
+					Name:        DefaultName,
+					URL:         mustURLParse("http://checkout.test"),
+					Probability: 1,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected an error: %t, got %v", tt.wantErr, err)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/checkout", nil)
+			proxy.ServeHTTP(httptest.NewRecorder(), req)
+			if real := rt.req.URL.Host; real != tt.wantHost {
+				t.Errorf("expected the request to be sent to %s, got %s", tt.wantHost, real)
+			}
+		})
+	}
+}
+
+func TestUpdateAllVersions(t *testing.T) {
+	main := []Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 1,
+		},
+	}
+	checkout := []Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://checkout.test"),
+			Probability: 1,
+		},
+	}
+
+	tests := []struct {
+		name         string
+		experiments  []Experiment
+		wantErr      bool
+		wantMain     string
+		wantCheckout string
+	}{
+		{
+			name:         "valid",
+			experiments:  []Experiment{{Name: "checkout", Versions: checkout}},
+			wantMain:     "default.test",
+			wantCheckout: "checkout.test",
+		},
+		{
+			name:         "invalid experiment",
+			experiments:  []Experiment{{Name: "checkout", Versions: main[:0]}},
+			wantErr:      true,
+			wantMain:     "green.test",
+			wantCheckout: "checkout-one-click.test",
+		},
+		{
+			name:         "unknown experiment",
+			experiments:  []Experiment{{Name: "checkout", Versions: checkout}, {Name: "unknown", Versions: checkout}},
+			wantErr:      true,
+			wantMain:     "green.test",
+			wantCheckout: "checkout-one-click.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &savingRoundtripper{}
+			proxy, err := New(testVersions(), WithTransport(rt), WithExperiment(testExperiment()))
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+
+			err = proxy.UpdateAllVersions(main, tt.experiments)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected an error: %t, got %v", tt.wantErr, err)
+			}
+
+			// Nothing should be updated unless all versions are valid
+			for path, expected := range map[string]string{"/": tt.wantMain, "/checkout": tt.wantCheckout} {
+				req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+				proxy.ServeHTTP(httptest.NewRecorder(), req)
+				if real := rt.req.URL.Host; real != expected {
+					t.Errorf("expected the request to %s to be sent to %s, got %s", path, expected, real)
+				}
+			}
+		})
+	}
+}
+
+func TestExperimentsConcurrentRequests(t *testing.T) {
+	search := testExperiment()
+	search.Name = "search"
+	search.Scope.PathPrefixes = []string{"/search"}
+	proxy, err := New(
+		testVersions(),
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"checkout-one-click.test": "one-click",
+			},
+		}),
+		WithExperiment(testExperiment()),
+		WithExperiment(search),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// The routing order is shared by all requests, and should not be modified by them
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/checkout", nil)
+			proxy.ServeHTTP(rec, req)
+			if real, expected := rec.Body.String(), "one-click"; real != expected {
+				t.Errorf("expected the body %s, got %s", expected, real)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,104 @@
+package revaboxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// FailoverPolicy makes responses with some status codes from a version, that is not the default one, count as failures
+// A failed request is retried against the default version, in the same way as when the version could not be reached
+type FailoverPolicy struct {
+	// The status codes that are treated as failures, like 502 and 503
+	StatusCodes []int
+	// The max size in bytes of request bodies that are buffered to be able to retry the request, defaults to 1MB
+	// Requests with larger bodies are not retried
+	MaxBodySize int64
+	// The header that is set on the response when the default version has been used instead,
+	// it will contain the name of the version that failed. Defaults to "Revaboxy-Failover"
+	Header string
+}
+
+// WithFailoverPolicy sets which status codes that should be treated as failures and retried against the default version
+// Only idempotent requests (GET, HEAD, OPTIONS, TRACE, PUT and DELETE) are retried
+func WithFailoverPolicy(policy FailoverPolicy) Setting {
+	return func(s *settings) {
+		if policy.MaxBodySize <= 0 {
+			policy.MaxBodySize = 1 << 20
+		}
+		if policy.Header == "" {
+			policy.Header = "Revaboxy-Failover"
+		}
+		s.failoverPolicy = &policy
+	}
+}
+
+func (p *FailoverPolicy) failure(statusCode int) bool {
+	for _, code := range p.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverStatusError is returned from ModifyResponse to make the reverse proxy use the error handler
+type failoverStatusError struct {
+	statusCode int
+}
+
+func (err *failoverStatusError) Error() string {
+	return fmt.Sprintf("responded with status %d", err.statusCode)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// prepareRetry buffers the body of the request, if it is small enough, so that it can be sent again to the default version
+func (state *requestState) prepareRetry(policy *FailoverPolicy, req *http.Request) error {
+	if !idempotent(req.Method) {
+		return nil
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		state.retryable = true
+		return nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, policy.MaxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > policy.MaxBodySize {
+		// Too large to be retried, the buffered part is sent first followed by the rest of the body
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil
+	}
+
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	state.body = buf
+	state.retryable = true
+	return nil
+}
+
+// retryBody sets the buffered body on a request that is retried
+func (state *requestState) retryBody(req *http.Request) {
+	if state.body == nil {
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(state.body))
+	req.ContentLength = int64(len(state.body))
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,133 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFailoverPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		wantBody     string
+		wantFailover bool
+	}{
+		{
+			name:         "get",
+			method:       http.MethodGet,
+			wantBody:     "default.test",
+			wantFailover: true,
+		},
+		{
+			name:         "put with body",
+			method:       http.MethodPut,
+			body:         "small body",
+			wantBody:     "default.test",
+			wantFailover: true,
+		},
+		{
+			name:         "put with too large body",
+			method:       http.MethodPut,
+			body:         "a body that is too large to be buffered",
+			wantBody:     "green.test",
+			wantFailover: false,
+		},
+		{
+			name:         "post",
+			method:       http.MethodPost,
+			body:         "small body",
+			wantBody:     "green.test",
+			wantFailover: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &testRoundTripper{
+				hostAnswer: map[string]string{
+					"default.test": "default.test",
+					"green.test":   "green.test",
+				},
+				hostStatus: map[string]int{
+					"green.test": http.StatusServiceUnavailable,
+				},
+			}
+
+			proxy, err := New(
+				testVersions(),
+				WithTransport(rt),
+				WithFailoverPolicy(FailoverPolicy{
+					StatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+					MaxBodySize: 16,
+				}),
+			)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, "http://example.com", strings.NewReader(tt.body))
+			proxy.ServeHTTP(rec, req)
+
+			if real, expected := rec.Body.String(), tt.wantBody; real != expected {
+				t.Fatalf("expected body %s, got %s", expected, real)
+			}
+			if real, expected := rt.bodies["green.test"], tt.body; real != expected {
+				t.Fatalf("expected the version to get the body %q, got %q", expected, real)
+			}
+
+			failoverHeader := rec.Header().Get("Revaboxy-Failover")
+			if !tt.wantFailover {
+				if failoverHeader != "" {
+					t.Fatalf("expected no failover header, got %s", failoverHeader)
+				}
+				return
+			}
+
+			if real, expected := failoverHeader, "green"; real != expected {
+				t.Fatalf("expected failover header %s, got %s", expected, real)
+			}
+			if real, expected := rt.bodies["default.test"], tt.body; real != expected {
+				t.Fatalf("expected the retried request to get the body %q, got %q", expected, real)
+			}
+		})
+	}
+}
+
+func TestFailoverPolicyDefaultVersion(t *testing.T) {
+	rt := &testRoundTripper{
+		hostAnswer: map[string]string{
+			"default.test": "default.test",
+		},
+		hostStatus: map[string]int{
+			"default.test": http.StatusServiceUnavailable,
+		},
+	}
+
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 1,
+			},
+		},
+		WithTransport(rt),
+		WithFailoverPolicy(FailoverPolicy{
+			StatusCodes: []int{http.StatusServiceUnavailable},
+		}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rec.Code, http.StatusServiceUnavailable; real != expected {
+		t.Fatalf("expected the status of the default version %d to be used, got %d", expected, real)
+	}
+}
@@ -0,0 +1,226 @@
+package revaboxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore is an AssignmentStore that saves the assignments in a file, so that they are kept over restarts
+// Every assignment is appended to the file, and the file is compacted to only contain the
+// assignments that has not expired when it is opened and when it has doubled in size since it was last compacted.
+// All assignments that has not expired are also kept in memory, and the file is written from a single goroutine
+// so that Get and Set never waits for the disk
+// It should be created with NewFileStore
+type FileStore struct {
+	path string
+
+	// mu guards the entries, and the fields used to hand over lines to the writer
+	mu      sync.Mutex
+	entries map[string]fileStoreEntry
+	lines   chan []byte
+	// Set when a line could not be queued since the writer was behind, the file is compacted to include it instead
+	missed bool
+	closed bool
+	// The last error of the writer, returned by the following call to Set
+	err error
+	wg  sync.WaitGroup
+
+	// Only used by the writer. The number of lines in the file, including the outdated ones,
+	// and the number of lines after the last compaction
+	file      *os.File
+	lineCount int
+	compacted int
+}
+
+type fileStoreEntry struct {
+	Key     string    `json:"key"`
+	Version string    `json:"version"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewFileStore opens the store at path, the file is created if it does not exist
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:    path,
+		entries: map[string]fileStoreEntry{},
+		lines:   make(chan []byte, 1000),
+	}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("could not read the assignment store %s: %s", path, err)
+	}
+	if err := s.compact(); err != nil {
+		return nil, fmt.Errorf("could not open the assignment store %s: %s", path, err)
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// load reads the assignments of the file, a missing file is treated as an empty store
+// Lines that can not be read, like one that was partially written during a crash, are skipped
+func (s *FileStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry fileStoreEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if now.After(entry.Expires) {
+			delete(s.entries, entry.Key)
+			continue
+		}
+		s.entries[entry.Key] = entry
+	}
+	return scanner.Err()
+}
+
+// run appends the queued lines to the file, and compacts it when it has doubled in size or a line was missed
+func (s *FileStore) run() {
+	defer s.wg.Done()
+	for line := range s.lines {
+		_, err := s.file.Write(line)
+		s.lineCount++
+
+		s.mu.Lock()
+		missed := s.missed
+		s.mu.Unlock()
+		if err == nil && (missed || (s.lineCount > 1000 && s.lineCount > 2*s.compacted)) {
+			err = s.compact()
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+	}
+}
+
+// compact rewrites the file with the assignments that has not expired, through a temporary file so that
+// a crash can not leave a partial file. The file is then opened to append new assignments
+// Only the copying of the assignments holds the lock, so Get and Set are not blocked while the file is written
+func (s *FileStore) compact() error {
+	s.mu.Lock()
+	now := time.Now()
+	entries := make([]fileStoreEntry, 0, len(s.entries))
+	for key, entry := range s.entries {
+		if now.After(entry.Expires) {
+			delete(s.entries, key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	s.missed = false
+	s.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		buf.Write(append(line, '\n'))
+	}
+	err = buf.Flush()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.lineCount = len(entries)
+	s.compacted = s.lineCount
+	return nil
+}
+
+// Get returns the version saved for the key
+func (s *FileStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return "", nil
+	}
+	return entry.Version, nil
+}
+
+// Set saves the assignment in memory, and queues it to be appended to the file
+// The error of the last write to the file, if any, is returned
+func (s *FileStore) Set(key, version string, expiry time.Duration) error {
+	entry := fileStoreEntry{
+		Key:     key,
+		Version: version,
+		Expires: time.Now().Add(expiry),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("the file store is closed")
+	}
+	s.entries[key] = entry
+	select {
+	case s.lines <- append(line, '\n'):
+	default:
+		s.missed = true
+	}
+
+	err, s.err = s.err, nil
+	return err
+}
+
+// Close writes the queued assignments and closes the file
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.lines)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	err := s.err
+	if s.missed && err == nil {
+		err = s.compact()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,398 @@
+package revaboxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Goals tracks conversions, and attributes them to the versions the user has been assigned
+// A goal is reached either by a request to the goal endpoint, like POST /__revaboxy/goal/signup?value=9.90,
+// or by a response from the backend that matches one of the rules. The goals are aggregated per version
+// in the status and counted in MetricGoals
+//
+// Goals are only counted for users that are part of an experiment, not for users that got the default version
+// since they were out of scope, not targeted, pinned or had a forced version
+type Goals struct {
+	// The path prefix of the goal endpoint, the name of the goal follows it. Defaults to "/__revaboxy/goal/"
+	Path string
+	// The names of the goals that may be reached through the endpoint, in addition to the names of the rules
+	// Other names are rejected, so that the clients can not create an unbounded number of goals
+	Names []string
+	// Rules that counts responses from the backend as goals
+	Rules []GoalRule
+}
+
+// GoalRule counts a response from the backend as a goal
+type GoalRule struct {
+	// The name of the goal
+	Name string
+	// The method of the request, any method matches if not set
+	Method string
+	// A glob, like "/checkout/*/done", that the path of the request has to match
+	Path string
+	// The status codes that counts as a goal, defaults to any 2xx status
+	StatusCodes []int
+	// Optional response header containing the numeric value of the goal, e.g. the revenue
+	// The header is removed before the response is sent to the client
+	ValueHeader string
+}
+
+// WithGoals enables the goal endpoint and counts the responses that matches the rules as goals
+func WithGoals(g Goals) Setting {
+	return func(s *settings) {
+		if g.Path == "" {
+			g.Path = "/__revaboxy/goal/"
+		}
+		if !strings.HasSuffix(g.Path, "/") {
+			g.Path += "/"
+		}
+		s.goals = &g
+	}
+}
+
+func (g *Goals) validate() error {
+	for _, rule := range g.Rules {
+		if rule.Name == "" {
+			return errors.New("all goal rules needs to have a name")
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowed checks if the goal may be reached through the endpoint, which is only the case for the goals of the names and the rules
+func (g *Goals) allowed(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, n := range g.Names {
+		if n == name {
+			return true
+		}
+	}
+	for _, rule := range g.Rules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks if the response is a goal of the rule, reqPath is the path of the request before it was sent to the version
+func (rule *GoalRule) matches(method, reqPath string, statusCode int) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, method) {
+		return false
+	}
+	if ok, _ := path.Match(rule.Path, reqPath); !ok {
+		return false
+	}
+	if len(rule.StatusCodes) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+	for _, code := range rule.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// GoalStats is the aggregated goals of a version
+type GoalStats struct {
+	// The number of times the goal has been reached
+	Count uint64 `json:"count"`
+	// The number of assigned users that has reached the goal, which are the conversions in the reports
+	// A user is only counted once for every goal, until it is assigned another version
+	Conversions uint64 `json:"conversions"`
+	// The sum of the values of the goal
+	Value float64 `json:"value,omitempty"`
+}
+
+// goalCounter aggregates the users and goals of the versions of an experiment
+type goalCounter struct {
+	mu sync.Mutex
+	// The number of users assigned each version
+	users map[string]uint64
+	// The stats of each goal, by the name of the version and the name of the goal
+	stats map[string]map[string]*GoalStats
+}
+
+func (c *goalCounter) addUser(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.users == nil {
+		c.users = map[string]uint64{}
+	}
+	c.users[version]++
+}
+
+// add records that a user reached the goal, repeat is set if the user had already reached it and is not a new conversion
+func (c *goalCounter) add(version, goal string, repeat bool, value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats == nil {
+		c.stats = map[string]map[string]*GoalStats{}
+	}
+	goals, ok := c.stats[version]
+	if !ok {
+		goals = map[string]*GoalStats{}
+		c.stats[version] = goals
+	}
+	stats, ok := goals[goal]
+	if !ok {
+		stats = &GoalStats{}
+		goals[goal] = stats
+	}
+	stats.Count++
+	stats.Value += value
+	if !repeat {
+		stats.Conversions++
+	}
+}
+
+// get returns a copy of the stats of all goals of the version, nil if no goal has been reached
+func (c *goalCounter) get(version string) map[string]GoalStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	goals, ok := c.stats[version]
+	if !ok {
+		return nil
+	}
+	stats := make(map[string]GoalStats, len(goals))
+	for name, s := range goals {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// counts returns the number of users and the goals of the version
+func (c *goalCounter) counts(version string) VersionCounts {
+	goals := c.get(version)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return VersionCounts{
+		Users: c.users[version],
+		Goals: goals,
+	}
+}
+
+// versions returns the names of all versions with users or goals, sorted
+func (c *goalCounter) versions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := map[string]bool{}
+	for name := range c.users {
+		seen[name] = true
+	}
+	for name := range c.stats {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addUser records that a new user was assigned the version
+func (e *experiment) addUser(s *settings, version string) {
+	e.goals.addUser(version)
+	if e.sampleRatio != nil {
+		now := time.Now()
+		var shares map[string]float64
+		if e.bandit != nil {
+			shares = e.bandit.getShares()
+		} else {
+			shares = e.getVersions().shares(now)
+		}
+		e.sampleRatio.observe(version, shares, now)
+	}
+}
+
+// reachGoal records that the user assigned the version reached the goal
+// It is a new conversion unless the goal is already in the conversions of the user
+func (e *experiment) reachGoal(s *settings, req *http.Request, conv *conversions, version, goal string, value float64) {
+	e.logf(s, "version %s reached the goal %s", version, goal)
+	repeat := !conv.reach(e.name, version, goal)
+	e.goals.add(version, goal, repeat, value)
+	if s.events != nil {
+		s.events.record(Event{
+			Type:       EventGoal,
+			Experiment: e.name,
+			Version:    version,
+			Path:       req.URL.Path,
+			Visitor:    s.visitor(req),
+			Goal:       goal,
+			Value:      value,
+			Repeat:     repeat,
+		})
+	}
+
+	labels := e.labels(version)
+	labels[LabelGoal] = goal
+	s.metrics.IncCounter(MetricGoals, labels)
+
+	if e.bandit != nil && e.bandit.config.RewardGoal == goal {
+		e.bandit.reward(version)
+	}
+}
+
+// serveGoal handles a request to the goal endpoint, the goal is attributed to the versions in the cookies of the user
+func (revaboxy *Revaboxy) serveGoal(w http.ResponseWriter, r *http.Request) {
+	settings := revaboxy.settings
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, settings.goals.Path)
+	if !settings.goals.allowed(name) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	value, err := parseGoalValue(r.FormValue("value"))
+	if err != nil {
+		http.Error(w, "the value of the goal needs to be a finite number", http.StatusBadRequest)
+		return
+	}
+
+	conv := settings.readConversions(r)
+	for _, e := range revaboxy.experiments {
+		if a := e.existing(settings, r); a != nil && a.tracked {
+			e.reachGoal(settings, r, conv, a.version.Name, name, value)
+		}
+	}
+	if cookie := conv.cookie(settings); cookie != nil {
+		http.SetCookie(w, cookie)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reachResponseGoals records the goals of the rules that matches the response, for all tracked assignments of the request
+func (s *settings) reachResponseGoals(state *requestState, resp *http.Response) {
+	conv := s.readConversions(resp.Request)
+	for i := range s.goals.Rules {
+		rule := &s.goals.Rules[i]
+		if !rule.matches(resp.Request.Method, state.url.Path, resp.StatusCode) {
+			continue
+		}
+
+		value := 0.0
+		if rule.ValueHeader != "" {
+			rawValue := resp.Header.Get(rule.ValueHeader)
+			var err error
+			if value, err = parseGoalValue(rawValue); err != nil {
+				s.logger.Printf("could not parse the value %s of the goal %s: %s", rawValue, rule.Name, err)
+			}
+		}
+
+		for _, a := range state.assignments {
+			if a.tracked {
+				a.experiment.reachGoal(s, resp.Request, conv, a.version.Name, rule.Name, value)
+			}
+		}
+	}
+	if cookie := conv.cookie(s); cookie != nil {
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+
+	for _, rule := range s.goals.Rules {
+		if rule.ValueHeader != "" {
+			resp.Header.Del(rule.ValueHeader)
+		}
+	}
+}
+
+// conversionsCookieSuffix is added to the cookie name for the cookie with the goals the user has reached
+// It can not be the cookie of an experiment, since their names are separated from the cookie name with "-"
+const conversionsCookieSuffix = ".goals"
+
+// maxConversions is the number of reached goals kept in the cookie, the oldest ones are removed first
+const maxConversions = 64
+
+// conversions are the goals the user has reached with the assigned versions, kept in a cookie so that a user is only
+// counted as a conversion once for every goal and version, without anything being saved in revaboxy
+type conversions struct {
+	keys    []string
+	changed bool
+}
+
+// readConversions reads the goals the user has reached from the cookie of the request
+func (s *settings) readConversions(req *http.Request) *conversions {
+	c := &conversions{}
+	if cookie, err := req.Cookie(s.cookieName + conversionsCookieSuffix); err == nil && cookie.Value != "" {
+		c.keys = strings.Split(cookie.Value, ".")
+	}
+	return c
+}
+
+// reach adds the goal reached with the version of the experiment, false is returned if it had already been reached
+func (c *conversions) reach(experiment, version, goal string) bool {
+	key := conversionKey(experiment, version, goal)
+	for _, k := range c.keys {
+		if k == key {
+			return false
+		}
+	}
+	c.keys = append(c.keys, key)
+	if len(c.keys) > maxConversions {
+		c.keys = c.keys[len(c.keys)-maxConversions:]
+	}
+	c.changed = true
+	return true
+}
+
+// cookie returns the cookie with the reached goals, nil if no new goal has been reached
+func (c *conversions) cookie(s *settings) *http.Cookie {
+	if !c.changed {
+		return nil
+	}
+	return &http.Cookie{
+		Name:     s.cookieName + conversionsCookieSuffix,
+		Value:    strings.Join(c.keys, "."),
+		Path:     "/",
+		Expires:  time.Now().Add(s.cookieExpiry),
+		HttpOnly: s.cookieHTTPOnly,
+	}
+}
+
+// conversionKey is a short hash of a goal reached with a version, which keeps the cookie small
+func conversionKey(experiment, version, goal string) string {
+	sum := sha256.Sum256([]byte(experiment + "\x00" + version + "\x00" + goal))
+	return hex.EncodeToString(sum[:4])
+}
+
+// parseGoalValue parses the value of a goal, an empty value is 0
+// Values that are not finite are rejected since they would make the sums of the goals useless, and can not be encoded as JSON
+func parseGoalValue(rawValue string) (float64, error) {
+	if rawValue == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("the value %s is not finite", rawValue)
+	}
+	return value, nil
+}
@@ -0,0 +1,248 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGoalEndpoint(t *testing.T) {
+	m := newTestMetrics()
+	proxy, err := New(
+		testVersions(),
+		WithTransport(&savingRoundtripper{}),
+		WithMetrics(m),
+		WithGoals(Goals{Names: []string{"signup"}, Rules: []GoalRule{{Name: "purchase", Path: "/checkout"}}}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		cookie     string
+		wantStatus int
+	}{
+		{name: "goal", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup?value=9.5", cookie: "green", wantStatus: http.StatusNoContent},
+		{name: "goal without value", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup", cookie: "green", wantStatus: http.StatusNoContent},
+		{name: "no cookie", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup", wantStatus: http.StatusNoContent},
+		{name: "goal of a rule", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/purchase", cookie: "green", wantStatus: http.StatusNoContent},
+		{name: "unknown goal", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/other", cookie: "green", wantStatus: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodGet, url: "http://example.com/__revaboxy/goal/signup", cookie: "green", wantStatus: http.StatusMethodNotAllowed},
+		{name: "invalid value", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup?value=much", cookie: "green", wantStatus: http.StatusBadRequest},
+		{name: "NaN value", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup?value=NaN", cookie: "green", wantStatus: http.StatusBadRequest},
+		{name: "infinite value", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup?value=-Inf", cookie: "green", wantStatus: http.StatusBadRequest},
+		{name: "overflowing value", method: http.MethodPost, url: "http://example.com/__revaboxy/goal/signup?value=1e400", cookie: "green", wantStatus: http.StatusBadRequest},
+	}
+	// The cookie with the reached goals is kept between the requests, like a browser would
+	var conversions *http.Cookie
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: tt.cookie})
+				if conversions != nil {
+					req.AddCookie(conversions)
+				}
+			}
+			proxy.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			for _, c := range rec.Result().Cookies() {
+				if c.Name == "revaboxy-name.goals" {
+					conversions = c
+				}
+			}
+		})
+	}
+
+	goals := proxy.Status()[0].Versions[1].Goals
+	if real, expected := goals["signup"], (GoalStats{Count: 2, Conversions: 1, Value: 9.5}); real != expected {
+		t.Errorf("expected the goal stats %+v, got %+v", expected, real)
+	}
+	if real, expected := m.counters[`revaboxy_goals_total{goal="signup",version="green"}`], 2; real != expected {
+		t.Errorf("expected %d goals to be counted, got %d", expected, real)
+	}
+}
+
+func TestGoalConversions(t *testing.T) {
+	tests := []struct {
+		name string
+		// The versions in the cookies of the requests reaching the goal
+		requests []string
+		// If the request has the cookie with the reached goals from the previous requests
+		keepCookies     []bool
+		wantConversions map[string]uint64
+	}{
+		{
+			name:            "same user",
+			requests:        []string{"green", "green", "green"},
+			keepCookies:     []bool{false, true, true},
+			wantConversions: map[string]uint64{"green": 1},
+		},
+		{
+			name:            "different users behind the same ip",
+			requests:        []string{"green", "green"},
+			keepCookies:     []bool{false, false},
+			wantConversions: map[string]uint64{"green": 2},
+		},
+		{
+			name:            "assigned another version",
+			requests:        []string{"green", DefaultName},
+			keepCookies:     []bool{false, true},
+			wantConversions: map[string]uint64{"green": 1, DefaultName: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := New(
+				testVersions(),
+				WithTransport(&testRoundTripper{
+					hostAnswer: map[string]string{
+						"default.test": "order placed",
+						"green.test":   "order placed",
+					},
+				}),
+				WithGoals(Goals{Rules: []GoalRule{{Name: "purchase", Path: "/checkout/done"}}}),
+			)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+			defer proxy.Close()
+
+			var conversions *http.Cookie
+			for i, version := range tt.requests {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodPost, "http://example.com/checkout/done", nil)
+				req.RemoteAddr = "10.0.0.1:1000"
+				req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: version})
+				if tt.keepCookies[i] && conversions != nil {
+					req.AddCookie(conversions)
+				}
+				proxy.ServeHTTP(rec, req)
+
+				for _, c := range rec.Result().Cookies() {
+					if c.Name == "revaboxy-name.goals" {
+						conversions = c
+					}
+				}
+			}
+
+			for _, v := range proxy.Status()[0].Versions {
+				if real, expected := v.Goals["purchase"].Conversions, tt.wantConversions[v.Name]; real != expected {
+					t.Errorf("expected %d conversions of %s, got %d", expected, v.Name, real)
+				}
+			}
+		})
+	}
+}
+
+func TestParseGoalValue(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantValue float64
+		wantErr   bool
+	}{
+		{value: "", wantValue: 0},
+		{value: "9.90", wantValue: 9.9},
+		{value: "-2", wantValue: -2},
+		{value: "much", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "+Inf", wantErr: true},
+		{value: "1e400", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			value, err := parseGoalValue(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected an error: %t, got %v", tt.wantErr, err)
+			}
+			if value != tt.wantValue {
+				t.Errorf("expected the value %v, got %v", tt.wantValue, value)
+			}
+		})
+	}
+}
+
+func TestGoalRules(t *testing.T) {
+	proxy, err := New(
+		testVersions(),
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"default.test": "order placed",
+				"green.test":   "order placed",
+			},
+			hostHeader: map[string]http.Header{
+				"default.test": {"X-Order-Value": {"20.5"}},
+				"green.test":   {"X-Order-Value": {"20.5"}},
+			},
+		}),
+		WithTargeting(MustParseTargeting(`!header("X-Bot")`)),
+		WithGoals(Goals{
+			Rules: []GoalRule{
+				{Name: "purchase", Method: http.MethodPost, Path: "/checkout/*/done", ValueHeader: "X-Order-Value"},
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	requests := []struct {
+		method string
+		path   string
+		bot    bool
+	}{
+		{method: http.MethodPost, path: "/checkout/42/done"},
+		{method: http.MethodGet, path: "/checkout/42/done"},
+		{method: http.MethodPost, path: "/checkout/42"},
+		// Requests that are not targeted gets the default version, and are not part of the experiment
+		{method: http.MethodPost, path: "/checkout/43/done", bot: true},
+	}
+	for _, r := range requests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(r.method, "http://example.com"+r.path, nil)
+		if r.bot {
+			req.Header.Set("X-Bot", "1")
+		}
+		proxy.ServeHTTP(rec, req)
+		if rec.Header().Get("X-Order-Value") != "" {
+			t.Fatal("expected the value header to be removed")
+		}
+	}
+
+	status := proxy.Status()[0]
+	if goals := status.Versions[0].Goals; goals != nil {
+		t.Errorf("expected no goals for the default version, got %+v", goals)
+	}
+	if real, expected := status.Versions[1].Goals["purchase"], (GoalStats{Count: 1, Conversions: 1, Value: 20.5}); real != expected {
+		t.Errorf("expected the goal stats %+v, got %+v", expected, real)
+	}
+}
+
+func TestGoalReward(t *testing.T) {
+	proxy, err := New(
+		testVersions(),
+		WithBandit(Bandit{RewardGoal: "signup"}),
+		WithGoals(Goals{Names: []string{"signup"}}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/__revaboxy/goal/signup", nil)
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: "green"})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := proxy.experiments[0].bandit.stats("green").Rewards, uint64(1); real != expected {
+		t.Errorf("expected %d rewards, got %d", expected, real)
+	}
+}
@@ -0,0 +1,150 @@
+package revaboxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveVersionHandler calls the handler of the version the request was assigned, in the same way as a request proxied to a url
+// The headers of the assigned versions are set on the request, and the cookies on the response. A failed response,
+// or a panic before the response has been written, is retried against the default version
+func (revaboxy *Revaboxy) serveVersionHandler(w http.ResponseWriter, r *http.Request, state *requestState) {
+	settings := revaboxy.settings
+	out := r.Clone(r.Context())
+	settings.setVersionHeaders(out, state)
+
+	if err := settings.serveHandler(w, out, state.target.handler, revaboxy.reverseProxy.ModifyResponse); err != nil {
+		revaboxy.reverseProxy.ErrorHandler(w, out, err)
+	}
+}
+
+// serveHandler calls the handler with a response writer that calls modifyResponse before the response header is written
+// If modifyResponse returns an error, or the handler panics before the header is written, the response is discarded and the error is returned
+func (s *settings) serveHandler(w http.ResponseWriter, req *http.Request, handler http.Handler, modifyResponse func(*http.Response) error) (err error) {
+	rw := s.newHandlerResponseWriter(w, req, modifyResponse)
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		if p == http.ErrAbortHandler || (rw.wroteHeader && rw.err == nil) {
+			panic(p)
+		}
+		err = fmt.Errorf("the handler panicked: %v", p)
+	}()
+
+	handler.ServeHTTP(rw, req)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.err
+}
+
+// newHandlerResponseWriter creates a response writer for a handler serving the request, the response is recorded in the metrics
+// and modified with modifyResponse, if it is set, before the header is written
+func (s *settings) newHandlerResponseWriter(w http.ResponseWriter, req *http.Request, modifyResponse func(*http.Response) error) *handlerResponseWriter {
+	start := time.Now()
+	return &handlerResponseWriter{
+		w:      w,
+		header: http.Header{},
+		onHeader: func(header http.Header, statusCode int) error {
+			s.recordResponse(req, start, statusCode)
+			if modifyResponse == nil {
+				return nil
+			}
+			return modifyResponse(&http.Response{StatusCode: statusCode, Header: header, Request: req})
+		},
+	}
+}
+
+// handlerResponseWriter keeps the header written by a handler apart until the status code is known,
+// so that the response can be modified or discarded before it is sent
+type handlerResponseWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	// Called with the header and status code before they are written, the response is discarded if it returns an error
+	onHeader    func(header http.Header, statusCode int) error
+	wroteHeader bool
+	err         error
+}
+
+func (rw *handlerResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *handlerResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	if rw.err = rw.onHeader(rw.header, statusCode); rw.err != nil {
+		return
+	}
+
+	header := rw.w.Header()
+	for name, values := range rw.header {
+		header[name] = values
+	}
+	rw.w.WriteHeader(statusCode)
+}
+
+func (rw *handlerResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+// Flush sends the written data to the client, if the underlying response writer supports it
+func (rw *handlerResponseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.w.(http.Flusher); ok && rw.err == nil {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, like for a WebSocket, if the underlying response writer supports it
+// The cookies and headers of revaboxy are not sent on a hijacked connection
+func (rw *handlerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil {
+		rw.wroteHeader = true
+	}
+	return conn, buf, err
+}
+
+// Push initiates an HTTP/2 server push, if the underlying response writer supports it
+func (rw *handlerResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rw.w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// ReadFrom writes the data from r, with the optimizations of the underlying response writer if it supports it
+func (rw *handlerResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return io.Copy(ioutil.Discard, r)
+	}
+	if rf, ok := rw.w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(rw.w, r)
+}
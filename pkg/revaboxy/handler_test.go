@@ -0,0 +1,188 @@
+package revaboxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// versionHandler answers with the name of the version, and the version header it received
+func versionHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", name)
+		fmt.Fprintf(w, "%s %s %s", name, r.Header.Get("Revaboxy-Name"), r.URL.Path)
+	})
+}
+
+func TestHandlerVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		green        http.Handler
+		wantVersion  string
+		wantBody     string
+		wantCookie   string
+		wantFailover string
+	}{
+		{
+			name:        "handler",
+			green:       versionHandler("green"),
+			wantVersion: "green",
+			wantBody:    "green green /path",
+			wantCookie:  "green",
+		},
+		{
+			name: "failed status",
+			green: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Version", "green")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("unavailable"))
+			}),
+			wantVersion:  DefaultName,
+			wantBody:     "default default /path",
+			wantFailover: "green",
+		},
+		{
+			name: "panic",
+			green: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("broken")
+			}),
+			wantVersion:  DefaultName,
+			wantBody:     "default default /path",
+			wantFailover: "green",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMetrics()
+			proxy, err := New(
+				[]Version{
+					{Name: DefaultName, Handler: versionHandler(DefaultName)},
+					{Name: "green", Handler: tt.green, Probability: 1},
+				},
+				WithMetrics(m),
+				WithFailoverPolicy(FailoverPolicy{StatusCodes: []int{http.StatusServiceUnavailable}}),
+			)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+			defer proxy.Close()
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/path", nil)
+			req.Header.Set("Revaboxy-Name", "spoofed")
+			proxy.ServeHTTP(rec, req)
+
+			resp := rec.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("expected the body %q, got %q", tt.wantBody, body)
+			}
+			if real := resp.Header.Get("Revaboxy-Failover"); real != tt.wantFailover {
+				t.Errorf("expected the failover header %q, got %q", tt.wantFailover, real)
+			}
+			if real := resp.Header.Get("X-Version"); real != tt.wantVersion {
+				t.Errorf("expected only the headers of the version %s, got %q", tt.wantVersion, real)
+			}
+
+			cookie := ""
+			if cookies := resp.Cookies(); len(cookies) > 0 {
+				cookie = cookies[0].Value
+			}
+			if cookie != tt.wantCookie {
+				t.Errorf("expected the cookie %q, got %q", tt.wantCookie, cookie)
+			}
+			if real, expected := m.counters[`revaboxy_responses_total{class="2xx",version="`+tt.wantVersion+`"}`], 1; real != expected {
+				t.Errorf("expected %d response to be counted, got %d", expected, real)
+			}
+		})
+	}
+}
+
+func TestHandlerVersionWithURL(t *testing.T) {
+	_, err := New([]Version{
+		{Name: DefaultName, URL: mustURLParse("http://default.test"), Handler: versionHandler(DefaultName)},
+	})
+	if err == nil {
+		t.Error("expected an error when both a URL and a handler is set")
+	}
+}
+
+func TestHandlerHealthCheck(t *testing.T) {
+	hc := newHealthChecker(&settings{}, "", "Revaboxy-Name")
+	unhealthy := &Version{
+		Name: "green",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	}
+	check := HealthCheck{Path: "/healthz"}.withDefaults()
+	if err := hc.check(unhealthy, check); err == nil || err.Error() != "expected a 2xx status, got 500" {
+		t.Errorf("expected the status of the handler to be checked, got %v", err)
+	}
+	if err := hc.check(&Version{Name: DefaultName, Handler: versionHandler(DefaultName)}, check); err != nil {
+		t.Errorf("expected the handler to be healthy, got %v", err)
+	}
+}
+
+func TestHandlerHijack(t *testing.T) {
+	// hijacker takes over the connection and answers on it directly, like a WebSocket upgrade would
+	hijacker := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error("could not hijack the connection", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+	})
+
+	tests := []struct {
+		name    string
+		handler func(t *testing.T) http.Handler
+	}{
+		{
+			name: "middleware",
+			handler: func(t *testing.T) http.Handler {
+				proxy, err := New([]Version{{Name: DefaultName, Probability: 1}})
+				if err != nil {
+					t.Fatal("could not create proxy", err)
+				}
+				return proxy.Middleware(hijacker)
+			},
+		},
+		{
+			name: "handler version",
+			handler: func(t *testing.T) http.Handler {
+				proxy, err := New([]Version{{Name: DefaultName, Handler: hijacker, Probability: 1}})
+				if err != nil {
+					t.Fatal("could not create proxy", err)
+				}
+				return proxy
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler(t))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if real, expected := string(body), "hijacked"; real != expected {
+				t.Errorf("expected the body %s, got %s", expected, real)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package revaboxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures active health checking of a version
+// An unhealthy version will not be assigned to new users, and users already assigned to it
+// will be sent to the default version until it has recovered
+type HealthCheck struct {
+	// The path that is requested, relative to every URL of the version until one of them is healthy
+	Path string
+	// How often the version is checked, defaults to 10 seconds
+	Interval time.Duration
+	// How long to wait for a response, defaults to 2 seconds
+	Timeout time.Duration
+	// The status code that is expected, defaults to any 2xx status
+	ExpectedStatus int
+	// The number of successful checks in a row before an unhealthy version is healthy again, defaults to 2
+	HealthyThreshold int
+	// The number of failed checks in a row before the version is unhealthy, defaults to 3
+	UnhealthyThreshold int
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	return hc
+}
+
+// HealthStatus is the current health of a version
+type HealthStatus struct {
+	// The name of the experiment, empty for the main experiment
+	Experiment string    `json:"experiment,omitempty"`
+	Version    string    `json:"version"`
+	Healthy    bool      `json:"healthy"`
+	LastCheck  time.Time `json:"last_check,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+type healthState struct {
+	HealthStatus
+	successes int
+	failures  int
+}
+
+// healthChecker runs the health checks of all versions of an experiment that has one configured
+type healthChecker struct {
+	settings   *settings
+	experiment string
+	headerName string
+
+	mu     sync.RWMutex
+	states map[string]*healthState
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	// runMu is held while the checks are stopped and started, so that concurrent updates does not overlap
+	runMu sync.Mutex
+}
+
+func newHealthChecker(s *settings, experiment, headerName string) *healthChecker {
+	return &healthChecker{
+		settings:   s,
+		experiment: experiment,
+		headerName: headerName,
+		states:     map[string]*healthState{},
+	}
+}
+
+// update stops the current checks and starts checking the new versions
+// The state of versions that still exist is kept
+func (hc *healthChecker) update(vv versions) {
+	hc.runMu.Lock()
+	defer hc.runMu.Unlock()
+
+	hc.stopChecks()
+
+	hc.mu.Lock()
+	states := map[string]*healthState{}
+	for name, v := range vv {
+		if v.HealthCheck == nil {
+			continue
+		}
+		state, ok := hc.states[name]
+		if !ok {
+			state = &healthState{HealthStatus: HealthStatus{Experiment: hc.experiment, Version: name, Healthy: true}}
+		}
+		states[name] = state
+	}
+	hc.states = states
+	hc.stop = make(chan struct{})
+	hc.mu.Unlock()
+
+	for _, v := range vv {
+		if v.HealthCheck != nil {
+			hc.wg.Add(1)
+			go hc.run(v, v.HealthCheck.withDefaults(), hc.stop)
+		}
+	}
+}
+
+func (hc *healthChecker) close() {
+	hc.runMu.Lock()
+	defer hc.runMu.Unlock()
+
+	hc.stopChecks()
+}
+
+// stopChecks stops the running checks, and waits for them to return
+func (hc *healthChecker) stopChecks() {
+	hc.mu.Lock()
+	if hc.stop != nil {
+		close(hc.stop)
+		hc.stop = nil
+	}
+	hc.mu.Unlock()
+	hc.wg.Wait()
+}
+
+func (hc *healthChecker) run(v *Version, check HealthCheck, stop chan struct{}) {
+	defer hc.wg.Done()
+
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	for {
+		hc.record(v.Name, check, hc.check(v, check))
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// check requests the health check path of the urls of the version, the version is healthy if any of them is
+// since requests are not sent to the urls that fails as long as another one works
+func (hc *healthChecker) check(v *Version, check HealthCheck) error {
+	bases := v.URLs
+	if v.URL != nil || len(v.URLs) == 0 {
+		bases = append([]*url.URL{v.URL}, v.URLs...)
+	}
+
+	var err error
+	for _, base := range bases {
+		if err = hc.checkURL(v, base, check); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkURL makes one request to the health check path of a url of the version, the path is requested from
+// the handler of the version if the url is nil
+func (hc *healthChecker) checkURL(v *Version, base *url.URL, check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	u := url.URL{Path: check.Path}
+	if base != nil {
+		u = *base
+		u.Path = singleJoiningSlash(u.Path, check.Path)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "revaboxy-health-check")
+	req.Header.Set(hc.headerName, v.Name)
+
+	statusCode, err := hc.status(v, req)
+	if err != nil {
+		return err
+	}
+
+	if check.ExpectedStatus != 0 && statusCode != check.ExpectedStatus {
+		return fmt.Errorf("expected status %d, got %d", check.ExpectedStatus, statusCode)
+	}
+	if check.ExpectedStatus == 0 && (statusCode < 200 || statusCode > 299) {
+		return fmt.Errorf("expected a 2xx status, got %d", statusCode)
+	}
+	return nil
+}
+
+// status makes the health check request to the version, the handler of the version is called directly if it has one
+func (hc *healthChecker) status(v *Version, req *http.Request) (statusCode int, err error) {
+	if v.Handler == nil {
+		resp, err := hc.settings.roundTripper.RoundTrip(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("the handler panicked: %v", p)
+		}
+	}()
+	rec := &statusRecorder{header: http.Header{}}
+	v.Handler.ServeHTTP(rec, req)
+	if rec.statusCode == 0 {
+		return http.StatusOK, nil
+	}
+	return rec.statusCode, nil
+}
+
+// statusRecorder is a response writer that only keeps the status code
+type statusRecorder struct {
+	header     http.Header
+	statusCode int
+}
+
+func (r *statusRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// record updates the state of the version with the result of a check, and logs if the health has changed
+func (hc *healthChecker) record(name string, check HealthCheck, err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	state, ok := hc.states[name]
+	if !ok {
+		return
+	}
+
+	state.LastCheck = time.Now()
+	if err != nil {
+		state.LastError = err.Error()
+		state.successes = 0
+		state.failures++
+		if state.Healthy && state.failures >= check.UnhealthyThreshold {
+			state.Healthy = false
+			hc.logf("version %s is unhealthy, sending its users to the default version: %s", name, err)
+		}
+		return
+	}
+
+	state.LastError = ""
+	state.failures = 0
+	state.successes++
+	if !state.Healthy && state.successes >= check.HealthyThreshold {
+		state.Healthy = true
+		hc.logf("version %s is healthy again", name)
+	}
+}
+
+func (hc *healthChecker) logf(format string, args ...interface{}) {
+	if hc.experiment != "" {
+		format = "experiment %s: " + format
+		args = append([]interface{}{hc.experiment}, args...)
+	}
+	hc.settings.logger.Printf(format, args...)
+}
+
+// healthy returns false if the version has a health check that has failed
+func (hc *healthChecker) healthy(name string) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	state, ok := hc.states[name]
+	return !ok || state.Healthy
+}
+
+// statuses returns the health of all versions with health checks, sorted by name
+func (hc *healthChecker) statuses() []HealthStatus {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	statuses := make([]HealthStatus, 0, len(hc.states))
+	for _, state := range hc.states {
+		statuses = append(statuses, state.HealthStatus)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses
+}
+
+// Health returns the current health of all versions, in all experiments, that has a health check
+func (revaboxy *Revaboxy) Health() []HealthStatus {
+	var statuses []HealthStatus
+	for _, e := range revaboxy.experiments {
+		statuses = append(statuses, e.health.statuses()...)
+	}
+	return statuses
+}
+
+// HealthHandler serves the health of all versions as JSON
+// The status code is 503 if any version is unhealthy
+func (revaboxy *Revaboxy) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statuses := revaboxy.Health()
+
+		status := http.StatusOK
+		for _, s := range statuses {
+			if !s.Healthy {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(statuses)
+	})
+}
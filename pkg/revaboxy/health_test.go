@@ -0,0 +1,188 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerThresholds(t *testing.T) {
+	rt := &testRoundTripper{hostAnswer: map[string]string{"green.test": "green.test"}}
+	hc := newHealthChecker(&settings{
+		logger:       &nopLogger{},
+		headerName:   "Revaboxy-Name",
+		roundTripper: rt,
+	}, "", "Revaboxy-Name")
+
+	check := HealthCheck{Path: "/healthz", UnhealthyThreshold: 2, HealthyThreshold: 2}.withDefaults()
+	v := &Version{Name: "green", URL: mustURLParse("http://green.test"), HealthCheck: &check}
+	hc.states["green"] = &healthState{HealthStatus: HealthStatus{Version: "green", Healthy: true}}
+
+	steps := []struct {
+		status      int
+		wantHealthy bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusOK, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusOK, false},
+		{http.StatusOK, true},
+	}
+	for i, step := range steps {
+		rt.setStatus("green.test", step.status)
+		hc.record("green", check, hc.check(v, check))
+		if real := hc.healthy("green"); real != step.wantHealthy {
+			t.Fatalf("step %d: expected healthy to be %v, got %v", i, step.wantHealthy, real)
+		}
+	}
+
+	check.ExpectedStatus = http.StatusNoContent
+	if err := hc.check(v, check); err == nil {
+		t.Fatal("expected an error when not getting the expected status")
+	}
+}
+
+func TestHealthCheckRouting(t *testing.T) {
+	rt := &testRoundTripper{hostAnswer: map[string]string{
+		"default.test": "default.test",
+		"green.test":   "green.test",
+	}}
+
+	versions := testVersions()
+	versions[1].HealthCheck = &HealthCheck{
+		Path:               "/healthz",
+		Interval:           time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+	proxy, err := New(versions, WithTransport(rt))
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	request := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		proxy.ServeHTTP(rec, req)
+		return rec
+	}
+
+	waitForHealth := func(healthy bool) {
+		for i := 0; i < 1000; i++ {
+			if proxy.experiments[0].health.healthy("green") == healthy {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("green never got healthy = %v", healthy)
+	}
+
+	if real, expected := request().Body.String(), "green.test"; real != expected {
+		t.Fatalf("expected %s, got %s", expected, real)
+	}
+
+	rt.setStatus("green.test", http.StatusInternalServerError)
+	waitForHealth(false)
+
+	rec := request()
+	if real, expected := rec.Body.String(), "default.test"; real != expected {
+		t.Fatalf("expected unhealthy version to be replaced with %s, got %s", expected, real)
+	}
+	if real, expected := len(rec.Result().Cookies()), 0; real != expected {
+		t.Fatalf("expected %d cookies, got %d", expected, real)
+	}
+
+	healthRec := httptest.NewRecorder()
+	proxy.HealthHandler().ServeHTTP(healthRec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if real, expected := healthRec.Code, http.StatusServiceUnavailable; real != expected {
+		t.Fatalf("expected health status code %d, got %d", expected, real)
+	}
+	if !strings.Contains(healthRec.Body.String(), `"healthy":false`) {
+		t.Fatalf("expected the health to contain the unhealthy version, got %s", healthRec.Body.String())
+	}
+
+	rt.setStatus("green.test", http.StatusOK)
+	waitForHealth(true)
+
+	if real, expected := request().Body.String(), "green.test"; real != expected {
+		t.Fatalf("expected %s after recovering, got %s", expected, real)
+	}
+}
+
+func TestHealthCheckConcurrentUpdates(t *testing.T) {
+	versions := testVersions()
+	versions[1].HealthCheck = &HealthCheck{Path: "/healthz", Interval: time.Millisecond}
+	proxy, err := New(versions, WithTransport(&testRoundTripper{hostAnswer: map[string]string{
+		"default.test": "default.test",
+		"green.test":   "green.test",
+	}}))
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := proxy.UpdateVersions(versions); err != nil {
+					t.Error("could not update versions", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every check that was started should be stopped, or closing would not return
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthCheckURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		version Version
+		status  map[string]int
+		wantErr bool
+	}{
+		{
+			name:    "only urls",
+			version: Version{Name: "green", URLs: []*url.URL{mustURLParse("http://green-1.test"), mustURLParse("http://green-2.test")}},
+			status:  map[string]int{"green-1.test": http.StatusOK, "green-2.test": http.StatusOK},
+		},
+		{
+			name:    "one unhealthy url",
+			version: Version{Name: "green", URL: mustURLParse("http://green-1.test"), URLs: []*url.URL{mustURLParse("http://green-2.test")}},
+			status:  map[string]int{"green-1.test": http.StatusInternalServerError, "green-2.test": http.StatusOK},
+		},
+		{
+			name:    "all urls unhealthy",
+			version: Version{Name: "green", URLs: []*url.URL{mustURLParse("http://green-1.test"), mustURLParse("http://green-2.test")}},
+			status:  map[string]int{"green-1.test": http.StatusInternalServerError},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &testRoundTripper{hostAnswer: map[string]string{}, hostStatus: tt.status}
+			for host := range tt.status {
+				rt.hostAnswer[host] = host
+			}
+			hc := newHealthChecker(&settings{roundTripper: rt}, "", "Revaboxy-Name")
+			err := hc.check(&tt.version, HealthCheck{Path: "/healthz"}.withDefaults())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected an error: %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package revaboxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an AssignmentStore that keeps the assignments in memory
+// When it is full, the least recently used assignment is removed
+// It should be created with NewMemoryStore
+type MemoryStore struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// The entries with the most recently used first
+	order *list.List
+}
+
+type storeEntry struct {
+	key     string
+	version string
+	expires time.Time
+}
+
+// NewMemoryStore creates a store with room for size assignments, 100000 is used if size is not positive
+func NewMemoryStore(size int) *MemoryStore {
+	if size <= 0 {
+		size = 100000
+	}
+	return &MemoryStore{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Get returns the version saved for the key
+func (s *MemoryStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return "", nil
+	}
+	entry := elem.Value.(*storeEntry)
+	if time.Now().After(entry.expires) {
+		s.order.Remove(elem)
+		delete(s.entries, key)
+		return "", nil
+	}
+	s.order.MoveToFront(elem)
+	return entry.version, nil
+}
+
+// Set saves the version for the key, and removes the least recently used assignment if the store is full
+func (s *MemoryStore) Set(key, version string, expiry time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(expiry)
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*storeEntry)
+		entry.version = version
+		entry.expires = expires
+		s.order.MoveToFront(elem)
+		return nil
+	}
+
+	s.entries[key] = s.order.PushFront(&storeEntry{key: key, version: version, expires: expires})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*storeEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of saved assignments, including expired ones that has not been removed yet
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
@@ -0,0 +1,112 @@
+package revaboxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Names of the metrics recorded by revaboxy
+const (
+	// MetricAssignments counts users without a cookie that were assigned a version
+	MetricAssignments = "revaboxy_assignments_total"
+	// MetricStickyHits counts requests that used the version stored in the cookie
+	MetricStickyHits = "revaboxy_sticky_hits_total"
+	// MetricStoreHits counts users without a valid cookie that used the version saved in the assignment store
+	MetricStoreHits = "revaboxy_store_hits_total"
+	// MetricInvalidCookieReassignments counts users that were assigned a new version since the cookie could not be used
+	MetricInvalidCookieReassignments = "revaboxy_invalid_cookie_reassignments_total"
+	// MetricFailovers counts requests that failed and were sent to the default version instead
+	MetricFailovers = "revaboxy_failovers_total"
+	// MetricOverrides counts requests that used a version forced with an override
+	MetricOverrides = "revaboxy_overrides_total"
+	// MetricPinned counts requests that used the version their user is pinned to by an allowlist
+	MetricPinned = "revaboxy_pinned_total"
+	// MetricRewards counts the rewards of versions in the bandit mode
+	MetricRewards = "revaboxy_rewards_total"
+	// MetricGoals counts the goals reached by the users of each version, with the name of the goal as the LabelGoal label
+	MetricGoals = "revaboxy_goals_total"
+	// MetricSampleRatioMismatches counts the times a sample ratio mismatch has been detected in an experiment
+	// It does not have the version label
+	MetricSampleRatioMismatches = "revaboxy_sample_ratio_mismatches_total"
+	// MetricEventsDropped counts the events that were dropped since the buffer of the event log was full
+	// It does not have any labels
+	MetricEventsDropped = "revaboxy_events_dropped_total"
+	// MetricPhaseTransitions counts the times an experiment has started or ended, with the new phase as the LabelPhase label
+	// It does not have the version label
+	MetricPhaseTransitions = "revaboxy_phase_transitions_total"
+	// MetricResponses counts the upstream responses, with the status class (2xx, 3xx...) as the "class" label
+	MetricResponses = "revaboxy_responses_total"
+	// MetricUpstreamLatency is a histogram of the time in seconds it took for the upstream to respond
+	MetricUpstreamLatency = "revaboxy_upstream_latency_seconds"
+)
+
+// Labels set on the metrics
+const (
+	// LabelVersion is the label containing the name of the version, it is set on all metrics except MetricPhaseTransitions
+	// MetricSampleRatioMismatches and MetricEventsDropped
+	LabelVersion = "version"
+	// LabelExperiment is the label containing the name of the experiment, it is set on all metrics
+	// except the ones of the main experiment and MetricEventsDropped
+	LabelExperiment = "experiment"
+	// LabelPhase is the label containing the phase an experiment has transitioned to, "running" or "ended"
+	LabelPhase = "phase"
+	// LabelGoal is the label containing the name of the goal on MetricGoals
+	LabelGoal = "goal"
+)
+
+// Metrics records metrics about the traffic passing through revaboxy
+// The names of the metrics are the Metric constants
+type Metrics interface {
+	// IncCounter increases the counter with one
+	IncCounter(name string, labels map[string]string)
+	// Observe records a value in the histogram
+	Observe(name string, labels map[string]string, value float64)
+}
+
+// WithMetrics sets where metrics should be recorded
+// NewPrometheusMetrics can be used to expose the metrics in the Prometheus format,
+// or an own implementation can be used to plug in another registry
+func WithMetrics(m Metrics) Setting {
+	return func(s *settings) {
+		s.metrics = m
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncCounter(string, map[string]string)       {}
+func (nopMetrics) Observe(string, map[string]string, float64) {}
+
+func versionLabels(version string) map[string]string {
+	return map[string]string{LabelVersion: version}
+}
+
+// metricsRoundTripper records the latency and status of all upstream requests
+// The version is read from the header of the routing experiment, which is always set by revaboxy before the request is sent
+type metricsRoundTripper struct {
+	settings *settings
+	next     http.RoundTripper
+}
+
+func (rt *metricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	rt.settings.recordResponse(req, start, resp.StatusCode)
+	return resp, nil
+}
+
+// recordResponse records the latency and status of a response from the version set in the header of the request
+func (s *settings) recordResponse(req *http.Request, start time.Time, statusCode int) {
+	e := getRequestState(req.Context()).route.experiment
+	version := req.Header.Get(e.headerName)
+	s.metrics.Observe(MetricUpstreamLatency, e.labels(version), time.Since(start).Seconds())
+
+	labels := e.labels(version)
+	labels["class"] = strconv.Itoa(statusCode/100) + "xx"
+	s.metrics.IncCounter(MetricResponses, labels)
+}
@@ -0,0 +1,84 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testMetrics struct {
+	counters     map[string]int
+	observations map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counters:     map[string]int{},
+		observations: map[string]int{},
+	}
+}
+
+func (m *testMetrics) IncCounter(name string, labels map[string]string) {
+	m.counters[name+"{"+formatLabels(labels)+"}"]++
+}
+
+func (m *testMetrics) Observe(name string, labels map[string]string, value float64) {
+	m.observations[name+"{"+formatLabels(labels)+"}"]++
+}
+
+func Test_WithMetrics(t *testing.T) {
+	m := newTestMetrics()
+
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 0,
+			},
+			{
+				Name:        "green",
+				URL:         mustURLParse("http://green.test"),
+				Probability: 1,
+			},
+		},
+		WithTransport(&testRoundTripper{
+			hostAnswer: map[string]string{
+				"default.test": "default-data",
+			},
+		}),
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	for _, cookieValue := range []string{"", "default", "unknown"} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if cookieValue != "" {
+			req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: cookieValue})
+		}
+		proxy.ServeHTTP(rec, req)
+	}
+
+	expectedCounters := map[string]int{
+		`revaboxy_assignments_total{version="green"}`:                  1,
+		`revaboxy_sticky_hits_total{version="default"}`:                1,
+		`revaboxy_invalid_cookie_reassignments_total{version="green"}`: 1,
+		`revaboxy_failovers_total{version="green"}`:                    2,
+		`revaboxy_responses_total{class="2xx",version="default"}`:      3,
+	}
+	for name, expected := range expectedCounters {
+		if real := m.counters[name]; real != expected {
+			t.Errorf("expected %s to be %d, got %d", name, expected, real)
+		}
+	}
+	if real, expected := len(m.counters), len(expectedCounters); real != expected {
+		t.Errorf("expected %d counters, got %d: %v", expected, real, m.counters)
+	}
+
+	if real, expected := m.observations[`revaboxy_upstream_latency_seconds{version="default"}`], 3; real != expected {
+		t.Errorf("expected %d latency observations, got %d", expected, real)
+	}
+}
@@ -0,0 +1,29 @@
+package revaboxy
+
+import (
+	"net/http"
+)
+
+// Middleware returns a handler that assigns versions to requests in the same way as ServeHTTP, but calls next
+// instead of sending the request to a version. The URLs and handlers of the versions are not used, and can be left out
+// The assigned version is available with VersionFromContext and in the version header of the request,
+// and the cookies are set on the response before it is written
+func (revaboxy *Revaboxy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, state := revaboxy.assignRequest(w, r)
+		if state == nil {
+			return
+		}
+
+		settings := revaboxy.settings
+		out := r.Clone(r.Context())
+		settings.setVersionHeaders(out, state)
+
+		// The request is not retried, so the failover policy does not apply
+		rw := settings.newHandlerResponseWriter(w, out, revaboxy.reverseProxy.ModifyResponse)
+		next.ServeHTTP(rw, out)
+		if !rw.wroteHeader {
+			rw.WriteHeader(http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package revaboxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	proxy, err := New(
+		[]Version{
+			{Name: DefaultName},
+			{Name: "green", Probability: 1},
+		},
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	var version *Version
+	var header string
+	handler := proxy.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version = VersionFromContext(r.Context())
+		header = r.Header.Get("Revaboxy-Name")
+		if r.URL.Path == "/write" {
+			w.Write([]byte("written"))
+		}
+	}))
+
+	tests := []struct {
+		name        string
+		path        string
+		cookie      string
+		wantVersion string
+		wantCookie  string
+	}{
+		{
+			name:        "new user",
+			path:        "/write",
+			wantVersion: "green",
+			wantCookie:  "green",
+		},
+		{
+			name:        "nothing written",
+			path:        "/",
+			wantVersion: "green",
+			wantCookie:  "green",
+		},
+		{
+			name:        "sticky user",
+			path:        "/write",
+			cookie:      DefaultName,
+			wantVersion: DefaultName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, header = nil, ""
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			req.Header.Set("Revaboxy-Name", "spoofed")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: tt.cookie})
+			}
+			handler.ServeHTTP(rec, req)
+
+			if version == nil || version.Name != tt.wantVersion {
+				t.Fatalf("expected the version %s in the context, got %+v", tt.wantVersion, version)
+			}
+			if header != tt.wantVersion {
+				t.Errorf("expected the header %s, got %s", tt.wantVersion, header)
+			}
+			resp := rec.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected the status 200, got %d", resp.StatusCode)
+			}
+			cookie := ""
+			if cookies := resp.Cookies(); len(cookies) > 0 {
+				cookie = cookies[0].Value
+			}
+			if cookie != tt.wantCookie {
+				t.Errorf("expected the cookie %q, got %q", tt.wantCookie, cookie)
+			}
+		})
+	}
+
+	if v := VersionFromContext(context.Background()); v != nil {
+		t.Errorf("expected no version in an empty context, got %+v", v)
+	}
+}
+
+func TestServeHTTPWithoutTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		green Version
+	}{
+		{
+			name:  "assigned version",
+			green: Version{Name: "green", Probability: 1},
+		},
+		{
+			name:  "default version after a failover",
+			green: Version{Name: "green", URL: mustURLParse("http://unknown.test"), Probability: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := New(
+				[]Version{{Name: DefaultName}, tt.green},
+				WithTransport(&testRoundTripper{}),
+				WithLogger(&nopLogger{}),
+			)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+			defer proxy.Close()
+
+			// Versions without a url, like the ones used with the middleware, can not be proxied to
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			proxy.ServeHTTP(rec, req)
+			if real, expected := rec.Code, http.StatusBadGateway; real != expected {
+				t.Errorf("expected the status %d, got %d", expected, real)
+			}
+		})
+	}
+}
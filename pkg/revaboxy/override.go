@@ -0,0 +1,179 @@
+package revaboxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Override makes it possible to force a version, e.g. for QA to check a version before it is released
+// The version is selected with the query parameter or header, like ?revaboxy=green, ahead of the cookie and random selection.
+// Versions of experiments added with WithExperiment are forced with "name:version", and several versions can be comma separated.
+// Adding "persist" to the list, like ?revaboxy=green,persist, also sets a cookie so that the following requests use the forced version.
+// It is a separate cookie from the one of the assigned version, so that the forced version is not counted in the experiment
+//
+// Only requests that contains the secret, or comes from one of the allowed ips, may force a version,
+// other requests are handled as if they did not try to. At least one of them has to be set
+type Override struct {
+	// The query parameter used to force versions, defaults to "revaboxy"
+	Query string
+	// The header used to force versions, defaults to "X-Revaboxy-Force"
+	Header string
+
+	// The shared secret that has to be sent in the secret header or query parameter
+	Secret string
+	// The header containing the secret, defaults to "X-Revaboxy-Secret"
+	SecretHeader string
+	// The query parameter containing the secret, defaults to "revaboxy_secret"
+	SecretQuery string
+
+	// The ip ranges of clients that may force versions without the secret
+	AllowedIPs []*net.IPNet
+}
+
+// WithOverride makes it possible to force versions with a query parameter or header
+// The override parameters are removed from the request before it is sent to the downstream service
+func WithOverride(o Override) Setting {
+	return func(s *settings) {
+		if o.Query == "" {
+			o.Query = "revaboxy"
+		}
+		if o.Header == "" {
+			o.Header = "X-Revaboxy-Force"
+		}
+		if o.SecretHeader == "" {
+			o.SecretHeader = "X-Revaboxy-Secret"
+		}
+		if o.SecretQuery == "" {
+			o.SecretQuery = "revaboxy_secret"
+		}
+		s.override = &o
+	}
+}
+
+func (o *Override) validate() error {
+	if o.Secret == "" && len(o.AllowedIPs) == 0 {
+		return errors.New("the override needs a secret or allowed ips, otherwise anyone could force a version")
+	}
+	return nil
+}
+
+// overrideCookieSuffix is added to the cookie name for the cookies of persisted overrides, followed by "-name" for experiments
+// They can not be the cookies of experiments, since their names are separated from the cookie name with "-"
+const overrideCookieSuffix = ".override"
+
+// overrides are the versions forced by a request
+type overrides struct {
+	// The forced version names, by the name of the experiment
+	versions map[string]string
+	persist  bool
+}
+
+// version returns the version forced for the experiment, if any
+func (o *overrides) version(experiment string) (string, bool) {
+	if o == nil {
+		return "", false
+	}
+	name, ok := o.versions[experiment]
+	return name, ok
+}
+
+// forced returns the versions forced by the request, nil is returned if the request does not force any,
+// or if it is not allowed to
+func (o *Override) forced(s *settings, req *http.Request) *overrides {
+	value := req.Header.Get(o.Header)
+	if value == "" {
+		value = req.URL.Query().Get(o.Query)
+	}
+	if value == "" {
+		return nil
+	}
+
+	if !o.authorized(req) {
+		s.logger.Printf("ignoring the forced version %s from an unauthorized client %s", value, req.RemoteAddr)
+		return nil
+	}
+
+	forced := &overrides{versions: map[string]string{}}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "persist" {
+			forced.persist = true
+			continue
+		}
+		if i := strings.Index(entry, ":"); i >= 0 {
+			forced.versions[entry[:i]] = entry[i+1:]
+		} else if entry != "" {
+			forced.versions[""] = entry
+		}
+	}
+	return forced
+}
+
+func (o *Override) authorized(req *http.Request) bool {
+	if o.Secret != "" {
+		secret := req.Header.Get(o.SecretHeader)
+		if secret == "" {
+			secret = req.URL.Query().Get(o.SecretQuery)
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(o.Secret)) == 1 {
+			return true
+		}
+	}
+	return containsIP(o.AllowedIPs, clientIP(req))
+}
+
+// strip returns the request without the override and the secret, so that they are not passed on
+// The request is cloned if it contains any of them, since the request of the caller must not be modified
+func (o *Override) strip(req *http.Request) *http.Request {
+	rawQuery, stripQuery := removeQueryKeys(req.URL.RawQuery, o.Query, o.SecretQuery)
+	_, hasOverride := req.Header[http.CanonicalHeaderKey(o.Header)]
+	_, hasSecret := req.Header[http.CanonicalHeaderKey(o.SecretHeader)]
+	if !stripQuery && !hasOverride && !hasSecret {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Del(o.Header)
+	req.Header.Del(o.SecretHeader)
+	req.URL.RawQuery = rawQuery
+	return req
+}
+
+// removeQueryKeys removes the parameters with the keys from a raw query, the order and escaping of the other parameters is kept
+func removeQueryKeys(rawQuery string, keys ...string) (string, bool) {
+	if rawQuery == "" {
+		return rawQuery, false
+	}
+
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		key := part
+		if i := strings.Index(key, "="); i >= 0 {
+			key = key[:i]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if !containsString(keys, key) {
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == len(parts) {
+		return rawQuery, false
+	}
+	return strings.Join(kept, "&"), true
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
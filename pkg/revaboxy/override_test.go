@@ -0,0 +1,205 @@
+package revaboxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name        string
+		url         string
+		header      http.Header
+		remoteAddr  string
+		wantHost    string
+		wantQuery   string
+		wantCookies map[string]string
+	}{
+		{
+			name:        "query with secret",
+			url:         "http://example.com/?z=1&revaboxy=green&a=b%2Fc&revaboxy_secret=s3cret&flag",
+			wantHost:    "green.test",
+			wantQuery:   "z=1&a=b%2Fc&flag",
+			wantCookies: map[string]string{},
+		},
+		{
+			name:        "header with secret",
+			url:         "http://example.com/",
+			header:      http.Header{"X-Revaboxy-Force": {"green"}, "X-Revaboxy-Secret": {"s3cret"}},
+			wantHost:    "green.test",
+			wantCookies: map[string]string{},
+		},
+		{
+			name:        "wrong secret",
+			url:         "http://example.com/?revaboxy=green&revaboxy_secret=guess",
+			wantHost:    "default.test",
+			wantCookies: map[string]string{"revaboxy-name": DefaultName},
+		},
+		{
+			name:        "allowed ip",
+			url:         "http://example.com/?revaboxy=green",
+			remoteAddr:  "10.0.0.1:1234",
+			wantHost:    "green.test",
+			wantCookies: map[string]string{},
+		},
+		{
+			name:        "not allowed ip",
+			url:         "http://example.com/?revaboxy=green",
+			remoteAddr:  "192.168.0.1:1234",
+			wantHost:    "default.test",
+			wantCookies: map[string]string{"revaboxy-name": DefaultName},
+		},
+		{
+			name:        "unknown version",
+			url:         "http://example.com/?revaboxy=blue&revaboxy_secret=s3cret",
+			wantHost:    "default.test",
+			wantCookies: map[string]string{"revaboxy-name": DefaultName},
+		},
+		{
+			name:        "persist",
+			url:         "http://example.com/?revaboxy=green,persist&revaboxy_secret=s3cret",
+			wantHost:    "green.test",
+			wantCookies: map[string]string{"revaboxy-name.override": "green"},
+		},
+		{
+			name:     "experiment",
+			url:      "http://example.com/checkout?revaboxy=green,checkout:one-click,persist&revaboxy_secret=s3cret",
+			wantHost: "checkout-one-click.test",
+			wantCookies: map[string]string{
+				"revaboxy-name.override":          "green",
+				"revaboxy-name.override-checkout": "one-click",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &savingRoundtripper{}
+			// New users get the default versions, unless overridden
+			versions := testVersions()
+			versions[0].Probability, versions[1].Probability = 1, 0
+			checkout := testExperiment()
+			checkout.Versions[0].Probability, checkout.Versions[1].Probability = 1, 0
+			proxy, err := New(
+				versions,
+				WithTransport(rt),
+				WithOverride(Override{
+					Secret:     "s3cret",
+					AllowedIPs: []*net.IPNet{allowed},
+				}),
+				WithExperiment(checkout),
+			)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			req.RemoteAddr = tt.remoteAddr
+			proxy.ServeHTTP(rec, req)
+
+			if real := rt.req.URL.Host; real != tt.wantHost {
+				t.Errorf("expected the request to be sent to %s, got %s", tt.wantHost, real)
+			}
+			if tt.wantQuery != "" && rt.req.URL.RawQuery != tt.wantQuery {
+				t.Errorf("expected the query %s, got %s", tt.wantQuery, rt.req.URL.RawQuery)
+			}
+			if rt.req.Header.Get("X-Revaboxy-Force") != "" || rt.req.Header.Get("X-Revaboxy-Secret") != "" {
+				t.Errorf("expected the override headers to be removed")
+			}
+			if real := req.URL.String(); real != tt.url {
+				t.Errorf("expected the request of the caller to be unchanged, got %s", real)
+			}
+			for name, values := range tt.header {
+				if real := req.Header.Get(name); real != values[0] {
+					t.Errorf("expected the header %s of the caller to be unchanged, got %q", name, real)
+				}
+			}
+
+			cookies := map[string]string{}
+			for _, c := range rec.Result().Cookies() {
+				cookies[c.Name] = c.Value
+			}
+			if len(cookies) != len(tt.wantCookies) {
+				t.Fatalf("expected cookies %v, got %v", tt.wantCookies, cookies)
+			}
+			for name, value := range tt.wantCookies {
+				if cookies[name] != value {
+					t.Errorf("expected cookie %s to be %s, got %s", name, value, cookies[name])
+				}
+			}
+		})
+	}
+}
+
+func TestOverridePersisted(t *testing.T) {
+	m := newTestMetrics()
+	rt := &savingRoundtripper{}
+	proxy, err := New(
+		testVersions(),
+		WithTransport(rt),
+		WithMetrics(m),
+		WithOverride(Override{Secret: "s3cret"}),
+		WithGoals(Goals{Names: []string{"signup"}, Rules: []GoalRule{{Name: "purchase", Path: "/checkout"}}}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/?revaboxy=default,persist&revaboxy_secret=s3cret", nil)
+	proxy.ServeHTTP(rec, req)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "revaboxy-name.override" {
+		t.Fatalf("expected only the override cookie to be set, got %v", cookies)
+	}
+
+	// The following requests use the forced version, without being counted in the experiment
+	for _, url := range []string{"http://example.com/checkout", "http://example.com/__revaboxy/goal/signup"} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		req.AddCookie(cookies[0])
+		proxy.ServeHTTP(rec, req)
+		if len(rec.Result().Cookies()) != 0 {
+			t.Errorf("expected no cookies to be set by %s, got %v", url, rec.Result().Cookies())
+		}
+	}
+
+	if real := rt.req.URL.Host; real != "default.test" {
+		t.Errorf("expected the request to be sent to the forced version, got %s", real)
+	}
+	for _, v := range proxy.Status()[0].Versions {
+		if len(v.Goals) != 0 {
+			t.Errorf("expected no goals to be counted for the forced version, got %v for %s", v.Goals, v.Name)
+		}
+	}
+	if real := m.counters[`revaboxy_sticky_hits_total{version="default"}`]; real != 0 {
+		t.Errorf("expected no sticky hits, got %d", real)
+	}
+	if real, expected := m.counters[`revaboxy_overrides_total{version="default"}`], 2; real != expected {
+		t.Errorf("expected %d overrides, got %d", expected, real)
+	}
+}
+
+func TestOverrideWithoutRestriction(t *testing.T) {
+	_, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 1,
+			},
+		},
+		WithOverride(Override{}),
+	)
+	if err == nil {
+		t.Fatal("expected an error when neither a secret nor allowed ips are set")
+	}
+}
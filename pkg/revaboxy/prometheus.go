@@ -0,0 +1,194 @@
+package revaboxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency histogram buckets
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metricHelp = map[string]string{
+	MetricAssignments:                "Users without a cookie that were assigned a version.",
+	MetricStickyHits:                 "Requests that used the version stored in the cookie.",
+	MetricStoreHits:                  "Users without a valid cookie that used the version saved in the assignment store.",
+	MetricInvalidCookieReassignments: "Users that were assigned a new version since the cookie could not be used.",
+	MetricFailovers:                  "Requests that failed and were sent to the default version instead.",
+	MetricOverrides:                  "Requests that used a version forced with an override.",
+	MetricPinned:                     "Requests that used the version their user is pinned to by an allowlist.",
+	MetricRewards:                    "Rewards of versions in the bandit mode.",
+	MetricGoals:                      "Goals reached by the users of each version.",
+	MetricSampleRatioMismatches:      "Times a sample ratio mismatch has been detected in an experiment.",
+	MetricEventsDropped:              "Events that were dropped since the buffer of the event log was full.",
+	MetricPhaseTransitions:           "Times an experiment has started or ended.",
+	MetricResponses:                  "Upstream responses by status class.",
+	MetricUpstreamLatency:            "Time in seconds for the upstream to respond.",
+}
+
+// PrometheusMetrics keeps metrics in memory and serves them in the Prometheus text exposition format
+// It should be created with NewPrometheusMetrics
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	typ    string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string
+	value  float64
+
+	bucketCounts []uint64
+	count        uint64
+}
+
+// NewPrometheusMetrics creates metrics that can be used with WithMetrics and served over http
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		buckets:  DefaultLatencyBuckets,
+		families: map[string]*metricFamily{},
+	}
+}
+
+// IncCounter increases the counter with one
+func (m *PrometheusMetrics) IncCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.series(name, "counter", labels).value++
+}
+
+// Observe records a value in the histogram
+func (m *PrometheusMetrics) Observe(name string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.series(name, "histogram", labels)
+	if s.bucketCounts == nil {
+		s.bucketCounts = make([]uint64, len(m.buckets))
+	}
+	for i, upper := range m.buckets {
+		if value <= upper {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (m *PrometheusMetrics) series(name, typ string, labels map[string]string) *metricSeries {
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{
+			typ:    typ,
+			series: map[string]*metricSeries{},
+		}
+		m.families[name] = family
+	}
+
+	formatted := formatLabels(labels)
+	s, ok := family.series[formatted]
+	if !ok {
+		s = &metricSeries{labels: formatted}
+		family.series[formatted] = s
+	}
+	return s
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *PrometheusMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		if help, ok := metricHelp[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.typ)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := family.series[key]
+			if family.typ != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+
+			for i, upper := range m.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="`+formatFloat(upper)+`"`)), s.bucketCounts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(s.labels), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(s.labels), s.count)
+		}
+	}
+}
+
+// formatLabels formats the labels as `a="1",b="2"` sorted by name
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(labels[name])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,45 @@
+package revaboxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheusMetricsFormat(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.buckets = []float64{0.1, 1}
+
+	m.IncCounter(MetricAssignments, versionLabels("green"))
+	m.IncCounter(MetricAssignments, versionLabels("green"))
+	m.IncCounter(MetricAssignments, versionLabels(`a"b`))
+	m.Observe(MetricUpstreamLatency, versionLabels("green"), 0.05)
+	m.Observe(MetricUpstreamLatency, versionLabels("green"), 0.5)
+
+	buf := &bytes.Buffer{}
+	m.write(buf)
+
+	expected := `# HELP revaboxy_assignments_total Users without a cookie that were assigned a version.
+# TYPE revaboxy_assignments_total counter
+revaboxy_assignments_total{version="a\"b"} 1
+revaboxy_assignments_total{version="green"} 2
+# HELP revaboxy_upstream_latency_seconds Time in seconds for the upstream to respond.
+# TYPE revaboxy_upstream_latency_seconds histogram
+revaboxy_upstream_latency_seconds_bucket{version="green",le="0.1"} 1
+revaboxy_upstream_latency_seconds_bucket{version="green",le="1"} 2
+revaboxy_upstream_latency_seconds_bucket{version="green",le="+Inf"} 2
+revaboxy_upstream_latency_seconds_sum{version="green"} 0.55
+revaboxy_upstream_latency_seconds_count{version="green"} 2
+`
+	if real := buf.String(); real != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, real)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/metrics", nil)
+	m.ServeHTTP(rec, req)
+	if real := rec.Body.String(); real != expected {
+		t.Fatalf("expected the same output over http, got:\n%s", real)
+	}
+}
@@ -0,0 +1,217 @@
+package revaboxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisOptions is how a RedisStore connects to the server
+type RedisOptions struct {
+	// The address of the server, like "localhost:6379"
+	Addr string
+	// The password sent with AUTH when connecting, no authentication is made if it is not set
+	Password string
+	// The database selected when connecting
+	DB int
+	// Prepended to all keys, defaults to "revaboxy:"
+	KeyPrefix string
+	// The max time to connect or make a command, defaults to 500ms
+	Timeout time.Duration
+	// The number of idle connections that are kept open, defaults to 10
+	MaxIdle int
+}
+
+// RedisStore is an AssignmentStore that saves the assignments in a server that speaks the Redis protocol,
+// so that they can be shared by several instances of revaboxy
+// It should be created with NewRedisStore
+type RedisStore struct {
+	options RedisOptions
+	idle    chan *redisConn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewRedisStore creates a store, connections are made when the store is used
+func NewRedisStore(options RedisOptions) *RedisStore {
+	if options.KeyPrefix == "" {
+		options.KeyPrefix = "revaboxy:"
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 500 * time.Millisecond
+	}
+	if options.MaxIdle <= 0 {
+		options.MaxIdle = 10
+	}
+	return &RedisStore{
+		options: options,
+		idle:    make(chan *redisConn, options.MaxIdle),
+	}
+}
+
+// Get returns the version saved for the key
+func (s *RedisStore) Get(key string) (string, error) {
+	reply, err := s.do("GET", s.options.KeyPrefix+key)
+	if err != nil {
+		return "", err
+	}
+	version, _ := reply.(string)
+	return version, nil
+}
+
+// Set saves the version for the key, with the expiry in milliseconds
+func (s *RedisStore) Set(key, version string, expiry time.Duration) error {
+	ms := expiry.Milliseconds()
+	if ms <= 0 {
+		ms = 1
+	}
+	_, err := s.do("SET", s.options.KeyPrefix+key, version, "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Close closes all idle connections, connections that are in use are closed when they are done
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.idle)
+	for c := range s.idle {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// do sends the command on an idle connection, or a new one if there is none
+// The reply is a string, an int64, or nil for a missing value
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.options.Timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The state of the connection is unknown after a network error
+		c.conn.Close()
+		return nil, err
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case c, ok := <-s.idle:
+		if ok {
+			return c, nil
+		}
+		return nil, errors.New("the redis store is closed")
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.options.Addr, s.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if s.options.Password != "" {
+		if _, err := c.do(s.options.Timeout, "AUTH", s.options.Password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not authenticate: %s", err)
+		}
+	}
+	if s.options.DB != 0 {
+		if _, err := c.do(s.options.Timeout, "SELECT", strconv.Itoa(s.options.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not select the database: %s", err)
+		}
+	}
+	return c, nil
+}
+
+// put returns the connection to the idle connections, it is closed if there is no room for it
+func (s *RedisStore) put(c *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		select {
+		case s.idle <- c:
+			return
+		default:
+		}
+	}
+	c.conn.Close()
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do writes the command as an array of bulk strings and reads the reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,145 @@
+package revaboxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is a stand-in for a Redis server that supports the commands used by RedisStore
+type respServer struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	expiries map[string]time.Duration
+	commands []string
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{
+		listener: listener,
+		password: password,
+		values:   map[string]string{},
+		expiries: map[string]time.Duration{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args[0])
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			authenticated = args[1] == s.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required\r\n"
+		case args[0] == "SELECT":
+			reply = "+OK\r\n"
+		case args[0] == "GET":
+			if value, ok := s.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+			ms, _ := strconv.Atoi(args[4])
+			s.values[args[1]] = args[2]
+			s.expiries[args[1]] = time.Duration(ms) * time.Millisecond
+			reply = "+OK\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newRESPServer(t, "secret")
+	defer server.listener.Close()
+
+	store := NewRedisStore(RedisOptions{Addr: server.listener.Addr().String(), Password: "secret", DB: 2})
+	defer store.Close()
+
+	if version, err := store.Get("visitor"); err != nil || version != "" {
+		t.Errorf("expected no version, got %q (%v)", version, err)
+	}
+	if err := store.Set("visitor", "green", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := store.Get("visitor"); err != nil || version != "green" {
+		t.Errorf("expected the version green, got %q (%v)", version, err)
+	}
+
+	server.mu.Lock()
+	if real, expected := server.expiries["revaboxy:visitor"], time.Hour; real != expected {
+		t.Errorf("expected the expiry %s, got %s", expected, real)
+	}
+	if real, expected := strings.Join(server.commands, ","), "AUTH,SELECT,GET,SET,GET"; real != expected {
+		t.Errorf("expected the connection to be reused for the commands %s, got %s", expected, real)
+	}
+	server.mu.Unlock()
+
+	wrongPassword := NewRedisStore(RedisOptions{Addr: server.listener.Addr().String(), Password: "wrong"})
+	defer wrongPassword.Close()
+	if _, err := wrongPassword.Get("visitor"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package revaboxy
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+)
+
+// ExperimentReport is the statistical results of an experiment, with every version compared to the default version
+type ExperimentReport struct {
+	// The name of the experiment, empty for the main experiment
+	Experiment string          `json:"experiment,omitempty"`
+	Versions   []VersionReport `json:"versions"`
+}
+
+// VersionReport is the results of a version
+type VersionReport struct {
+	Name string `json:"name"`
+	// The number of users that has been assigned the version
+	Users uint64 `json:"users"`
+	// The results of each goal, by the name of the goal
+	Goals map[string]GoalReport `json:"goals,omitempty"`
+}
+
+// GoalReport is the results of a goal of a version
+type GoalReport struct {
+	// The number of distinct users that has reached the goal
+	Conversions uint64 `json:"conversions"`
+	// The total value of the goal
+	Value          float64 `json:"value,omitempty"`
+	ConversionRate float64 `json:"conversion_rate"`
+	// The 95% confidence interval of the conversion rate
+	ConfidenceInterval [2]float64 `json:"confidence_interval"`
+	// The comparison with the default version, not set for the default version itself or if the default version has no users
+	Comparison *Comparison `json:"comparison,omitempty"`
+}
+
+// Comparison is how the conversion rate of a version compares to the conversion rate of the default version
+type Comparison struct {
+	// The difference in conversion rate, and its 95% confidence interval
+	AbsoluteLift         float64    `json:"absolute_lift"`
+	AbsoluteLiftInterval [2]float64 `json:"absolute_lift_interval"`
+	// The difference in conversion rate relative to the rate of the default version, 0 if the default version has no conversions
+	RelativeLift float64 `json:"relative_lift"`
+	// The p-value of a two-sided two-proportion z-test
+	PValue float64 `json:"p_value"`
+	// The probability that the version has a higher conversion rate than the default version,
+	// with a uniform prior on the conversion rates
+	ProbabilityToBeatDefault float64 `json:"probability_to_beat_default"`
+}
+
+// VersionCounts are the number of users and goals of a version that a report is created from
+type VersionCounts struct {
+	Users uint64
+	Goals map[string]GoalStats
+}
+
+// z95 is the quantile of the standard normal distribution used for the 95% confidence intervals
+const z95 = 1.959963984540054
+
+// bayesianDraws is the number of samples used to estimate the probability to beat the default version
+const bayesianDraws = 20000
+
+// NewExperimentReport creates the report of an experiment from the counts of its versions, by the name of the version
+// The conversions are the distinct users that reached a goal, capped to the number of users of the version
+func NewExperimentReport(experiment string, counts map[string]VersionCounts) ExperimentReport {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := ExperimentReport{
+		Experiment: experiment,
+		Versions:   make([]VersionReport, 0, len(names)),
+	}
+	control, hasControl := counts[DefaultName]
+	for _, name := range names {
+		c := counts[name]
+		vr := VersionReport{
+			Name:  name,
+			Users: c.Users,
+		}
+		for goal, stats := range c.Goals {
+			if vr.Goals == nil {
+				vr.Goals = map[string]GoalReport{}
+			}
+			conversions := minUint64(stats.Conversions, c.Users)
+			gr := GoalReport{
+				Conversions:        conversions,
+				Value:              stats.Value,
+				ConversionRate:     rate(conversions, c.Users),
+				ConfidenceInterval: wilsonInterval(conversions, c.Users),
+			}
+			if name != DefaultName && hasControl && control.Users > 0 {
+				controlConversions := minUint64(control.Goals[goal].Conversions, control.Users)
+				gr.Comparison = compare(controlConversions, control.Users, conversions, c.Users)
+			}
+			vr.Goals[goal] = gr
+		}
+		report.Versions = append(report.Versions, vr)
+	}
+	return report
+}
+
+// compare compares the conversions of a version with the conversions of the default version
+func compare(controlConversions, controlUsers, conversions, users uint64) *Comparison {
+	p1, p2 := rate(controlConversions, controlUsers), rate(conversions, users)
+	n1, n2 := float64(controlUsers), float64(users)
+
+	c := &Comparison{
+		AbsoluteLift: p2 - p1,
+		PValue:       1,
+	}
+	if p1 > 0 {
+		c.RelativeLift = (p2 - p1) / p1
+	}
+	if n1 > 0 && n2 > 0 {
+		se := math.Sqrt(p1*(1-p1)/n1 + p2*(1-p2)/n2)
+		c.AbsoluteLiftInterval = [2]float64{c.AbsoluteLift - z95*se, c.AbsoluteLift + z95*se}
+
+		pooled := float64(controlConversions+conversions) / (n1 + n2)
+		pooledSE := math.Sqrt(pooled * (1 - pooled) * (1/n1 + 1/n2))
+		if pooledSE > 0 {
+			z := (p2 - p1) / pooledSE
+			c.PValue = math.Erfc(math.Abs(z) / math.Sqrt2)
+		}
+	}
+	c.ProbabilityToBeatDefault = probabilityToBeat(controlConversions, controlUsers, conversions, users)
+	return c
+}
+
+// probabilityToBeat estimates the probability that the conversion rate of the version is higher than the rate of the control,
+// by sampling their beta posteriors. A fixed seed is used so that the same counts always gives the same report
+func probabilityToBeat(controlConversions, controlUsers, conversions, users uint64) float64 {
+	r := rand.New(rand.NewSource(1))
+	wins := 0
+	for i := 0; i < bayesianDraws; i++ {
+		control := betaSample(r, float64(controlConversions)+1, float64(controlUsers-controlConversions)+1)
+		version := betaSample(r, float64(conversions)+1, float64(users-conversions)+1)
+		if version > control {
+			wins++
+		}
+	}
+	return float64(wins) / bayesianDraws
+}
+
+// wilsonInterval is the 95% Wilson score interval of a conversion rate
+func wilsonInterval(conversions, users uint64) [2]float64 {
+	if users == 0 {
+		return [2]float64{0, 1}
+	}
+	n := float64(users)
+	p := float64(conversions) / n
+	denominator := 1 + z95*z95/n
+	center := (p + z95*z95/(2*n)) / denominator
+	margin := z95 * math.Sqrt(p*(1-p)/n+z95*z95/(4*n*n)) / denominator
+	return [2]float64{math.Max(0, center-margin), math.Min(1, center+margin)}
+}
+
+func rate(conversions, users uint64) float64 {
+	if users == 0 {
+		return 0
+	}
+	return float64(conversions) / float64(users)
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Report returns the statistical results of all experiments, from the users and goals counted since revaboxy was started
+func (revaboxy *Revaboxy) Report() []ExperimentReport {
+	reports := make([]ExperimentReport, 0, len(revaboxy.experiments))
+	for _, e := range revaboxy.experiments {
+		counts := map[string]VersionCounts{}
+		for _, name := range e.getVersions().names() {
+			counts[name] = e.goals.counts(name)
+		}
+		reports = append(reports, NewExperimentReport(e.name, counts))
+	}
+	return reports
+}
+
+// ReportHandler serves the statistical results of all experiments as JSON
+func (revaboxy *Revaboxy) ReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(revaboxy.Report())
+	})
+}
+
+// ReportFromEvents creates the reports of all experiments from events in the format written to the event file
+func ReportFromEvents(r io.Reader) ([]ExperimentReport, error) {
+	counters := map[string]*goalCounter{}
+	var experiments []string
+	err := ReadEvents(r, func(e Event) error {
+		c, ok := counters[e.Experiment]
+		if !ok {
+			c = &goalCounter{}
+			counters[e.Experiment] = c
+			experiments = append(experiments, e.Experiment)
+		}
+		switch e.Type {
+		case EventAssignment:
+			// Events written before the assignment was recorded are all new users
+			if e.Assignment == AssignmentNew || e.Assignment == "" {
+				c.addUser(e.Version)
+			}
+		case EventGoal:
+			c.add(e.Version, e.Goal, e.Repeat, e.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(experiments)
+	reports := make([]ExperimentReport, 0, len(experiments))
+	for _, name := range experiments {
+		c := counters[name]
+		counts := map[string]VersionCounts{}
+		for _, version := range c.versions() {
+			counts[version] = c.counts(version)
+		}
+		reports = append(reports, NewExperimentReport(name, counts))
+	}
+	return reports, nil
+}
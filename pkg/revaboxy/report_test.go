@@ -0,0 +1,110 @@
+package revaboxy
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewExperimentReport(t *testing.T) {
+	report := NewExperimentReport("checkout", map[string]VersionCounts{
+		DefaultName: {Users: 1000, Goals: map[string]GoalStats{"purchase": {Count: 120, Conversions: 100, Value: 500}}},
+		"green":     {Users: 1000, Goals: map[string]GoalStats{"purchase": {Count: 130, Conversions: 130}}},
+		"blue":      {Users: 10, Goals: map[string]GoalStats{"purchase": {Count: 20, Conversions: 20}}},
+	})
+	if real, expected := len(report.Versions), 3; real != expected {
+		t.Fatalf("expected %d versions, got %d", expected, real)
+	}
+
+	closeTo := func(name string, real, expected, tolerance float64) {
+		t.Helper()
+		if math.Abs(real-expected) > tolerance {
+			t.Errorf("expected %s to be %v, got %v", name, expected, real)
+		}
+	}
+
+	control := report.Versions[1].Goals["purchase"]
+	if control.Comparison != nil {
+		t.Error("expected the default version to not be compared with itself")
+	}
+	closeTo("the conversion rate", control.ConversionRate, 0.1, 1e-9)
+	closeTo("the lower bound of the interval", control.ConfidenceInterval[0], 0.0829, 1e-4)
+	closeTo("the upper bound of the interval", control.ConfidenceInterval[1], 0.1202, 1e-4)
+
+	green := report.Versions[2].Goals["purchase"].Comparison
+	closeTo("the absolute lift", green.AbsoluteLift, 0.03, 1e-9)
+	closeTo("the relative lift", green.RelativeLift, 0.3, 1e-9)
+	closeTo("the lower bound of the lift interval", green.AbsoluteLiftInterval[0], 0.0020, 1e-4)
+	closeTo("the p-value", green.PValue, 0.0355, 1e-4)
+	closeTo("the probability to beat default", green.ProbabilityToBeatDefault, 0.98, 0.01)
+
+	// More conversions than users are capped
+	if real, expected := report.Versions[0].Goals["purchase"].ConversionRate, 1.0; real != expected {
+		t.Errorf("expected the capped conversion rate %v, got %v", expected, real)
+	}
+}
+
+func TestReportFromEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revaboxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	eventFile := filepath.Join(dir, "events.jsonl")
+
+	proxy, err := New(
+		testVersions(),
+		WithTransport(&savingRoundtripper{}),
+		WithGoals(Goals{Names: []string{"signup"}}),
+		WithEventLog(EventLog{File: EventFile{Path: eventFile}}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		proxy.ServeHTTP(rec, req)
+	}
+	// A user that reaches the goal twice is one conversion
+	cookies := []*http.Cookie{{Name: "revaboxy-name", Value: "green"}}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "http://example.com/__revaboxy/goal/signup?value=5", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		proxy.ServeHTTP(rec, req)
+		cookies = append(cookies, rec.Result().Cookies()...)
+	}
+
+	report := proxy.Report()
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	green := report[0].Versions[1]
+	if green.Users != 4 || green.Goals["signup"].Conversions != 1 || green.Goals["signup"].Value != 10 {
+		t.Errorf("expected 4 users and 1 conversion with the value 10, got %+v", green)
+	}
+
+	f, err := os.Open(eventFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fromEvents, err := ReportFromEvents(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Versions without any users are only known by the running proxy
+	report[0].Versions = report[0].Versions[1:]
+	if !reflect.DeepEqual(fromEvents, report) {
+		t.Errorf("expected the report from the events to be %+v, got %+v", report, fromEvents)
+	}
+}
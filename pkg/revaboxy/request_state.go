@@ -0,0 +1,44 @@
+package revaboxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+type requestStateKey struct{}
+
+// versionKey is the context key of the version that the request is sent to
+type versionKey struct{}
+
+// requestState is the state of a request passing through revaboxy, it is stored in the request context
+type requestState struct {
+	// The assigned versions of all experiments that applies to the request, or that the user already has been assigned to
+	assignments []*assignment
+	// The assignment of the experiment that decides where the request is sent
+	route *assignment
+	// The url of the version that the request is sent to
+	target *target
+	// The url of the request before it was modified to target a version
+	url url.URL
+	// If the request can be retried against the default version, and the buffered body to use when doing so
+	retryable bool
+	body      []byte
+}
+
+func getRequestState(ctx context.Context) *requestState {
+	return ctx.Value(requestStateKey{}).(*requestState)
+}
+
+// VersionFromContext returns the version that a request is sent to, from the context of a request passed on by revaboxy
+// It is available to the Transport, the handlers of versions and the handler wrapped by Middleware,
+// and is the default version if the request failed over. Nil is returned if the context has no version
+func VersionFromContext(ctx context.Context) *Version {
+	v, _ := ctx.Value(versionKey{}).(*Version)
+	return v
+}
+
+// withVersion returns the request with the version it is sent to in its context
+func withVersion(req *http.Request, v *Version) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), versionKey{}, v))
+}
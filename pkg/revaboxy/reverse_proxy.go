@@ -1,6 +1,9 @@
 package revaboxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -12,7 +15,12 @@ import (
 // It does also save which test i run on the client through cookies and serve the same version on subsequent requests
 // The revaboxy handler should be created with New
 type Revaboxy struct {
+	settings     *settings
 	reverseProxy *httputil.ReverseProxy
+	// The main experiment, followed by the experiments added with WithExperiment
+	experiments []*experiment
+	// The experiments in the order they are checked for routing, with the main experiment last since it applies to all requests
+	routing []*experiment
 }
 
 // DefaultName is the name of the default version
@@ -26,8 +34,27 @@ type Version struct {
 	Name string
 	// The URL to the root of the target
 	URL *url.URL
+	// The handler that is called directly, instead of proxying the request to a URL. It can not be set together with URL
+	// The request is the one received by revaboxy, with the headers of the assigned versions set
+	Handler http.Handler
+	// Additional URLs to the root of other instances of the same target, requests are load balanced between all URLs
+	// Health checks are only made against URL
+	URLs []*url.URL
+	// The strategy used to balance requests between the URLs, defaults to RoundRobin
+	LoadBalancing LoadBalancing
 	// The probability from 0-1 of this version being used
 	Probability float64
+	// Optional active health checking of the version
+	HealthCheck *HealthCheck
+	// Optional list of users that always get this version
+	Allowlist *Allowlist
+	// Optional schedule that changes the probability over time
+	Schedule *Schedule
+	// The minimum and maximum share of new users that the version gets in the bandit mode, no max is used if MaxShare is 0
+	MinShare float64
+	MaxShare float64
+
+	balancer *balancer
 }
 
 // Logger is the logger interface used with revaboxy
@@ -39,10 +66,39 @@ type settings struct {
 	logger     Logger
 	headerName string
 
-	cookieName   string
-	cookieExpiry time.Duration
+	cookieName     string
+	cookieExpiry   time.Duration
+	cookieHTTPOnly bool
+
+	responseHeader string
 
 	roundTripper http.RoundTripper
+	metrics      Metrics
+
+	bucketingKey *BucketingKey
+	visitorSalt  string
+	cookieSigner *cookieSigner
+
+	spoofedHeaderPolicy SpoofedHeaderPolicy
+	failoverPolicy      *FailoverPolicy
+
+	ejectionDuration time.Duration
+
+	scope       *Scope
+	targeting   *Targeting
+	override    *Override
+	window      *Window
+	bandit      *Bandit
+	goals       *Goals
+	experiments []Experiment
+
+	sampleRatioCheck *SampleRatioCheck
+
+	eventLog *EventLog
+	events   *eventWriter
+
+	stickiness *Stickiness
+	store      AssignmentStore
 }
 
 // Setting changes the revaboxy settings
@@ -86,6 +142,23 @@ func WithCookieExpiry(expiry time.Duration) Setting {
 	}
 }
 
+// WithCookieHTTPOnly sets if the cookie should be HttpOnly, which hides it from JavaScript in the browser
+// The cookie is not HttpOnly by default, so that front-end code can read the version
+func WithCookieHTTPOnly(httpOnly bool) Setting {
+	return func(s *settings) {
+		s.cookieHTTPOnly = httpOnly
+	}
+}
+
+// WithResponseHeader sets a header, like "X-Revaboxy-Version", on the responses that contains the name of the version used
+// Experiments added with WithExperiment uses the name followed by the name of the experiment, in the same way as the request header
+// No header is set on the responses by default
+func WithResponseHeader(headerName string) Setting {
+	return func(s *settings) {
+		s.responseHeader = headerName
+	}
+}
+
 // New creates a revaboxy client. Versions required but, any number of additional settings may be provided
 func New(vv []Version, settingChangers ...Setting) (*Revaboxy, error) {
 	// Default values
@@ -95,58 +168,138 @@ func New(vv []Version, settingChangers ...Setting) (*Revaboxy, error) {
 		cookieName:   "revaboxy-name",
 		cookieExpiry: time.Hour * 24 * 7,
 		roundTripper: http.DefaultTransport,
+		metrics:      nopMetrics{},
+
+		ejectionDuration: 30 * time.Second,
 	}
 	// Apply all settings
 	for _, s := range settingChangers {
 		s(settings)
 	}
 
-	logger := settings.logger
+	transport := &metricsRoundTripper{
+		settings: settings,
+		next:     settings.roundTripper,
+	}
+
+	revaboxy := &Revaboxy{
+		settings: settings,
+	}
 
-	// Add all versions
-	versions := versions{}
-	for _, v := range vv {
-		err := versions.add(v)
+	if settings.scope != nil {
+		if err := settings.scope.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.override != nil {
+		if err := settings.override.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.window != nil {
+		if err := settings.window.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.goals != nil {
+		if err := settings.goals.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.sampleRatioCheck != nil {
+		if err := settings.sampleRatioCheck.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.eventLog != nil {
+		events, err := newEventWriter(settings, *settings.eventLog)
 		if err != nil {
 			return nil, err
 		}
+		settings.events = events
 	}
-	if err := versions.valid(); err != nil {
+	if settings.stickiness != nil {
+		store, err := settings.stickiness.openStore()
+		if err != nil {
+			settings.events.close()
+			return nil, err
+		}
+		settings.store = store
+	}
+	main, err := newExperiment(settings, "", vv, settings.window, settings.bandit)
+	if err != nil {
+		settings.events.close()
+		settings.closeStore()
 		return nil, err
 	}
+	main.scope = settings.scope
+	main.targeting = settings.targeting
+	revaboxy.experiments = append(revaboxy.experiments, main)
+
+	names := map[string]bool{}
+	for _, e := range settings.experiments {
+		if err := e.validate(names); err != nil {
+			revaboxy.Close()
+			return nil, err
+		}
+		names[e.Name] = true
 
-	// The director changes the request. If the user has already been assigned a version, that one will be used.
-	// Otherwise a random version will be assigned to the user
-	director := func(req *http.Request) {
-		cookie, _ := req.Cookie(settings.cookieName)
-
-		if cookie != nil {
-			version, ok := versions[cookie.Value]
-			if ok {
-				logger.Printf("using previous used version %s", version.Name)
-				modifyRequest(settings, req, version)
-			} else {
-				logger.Printf("could not use previous version %s and using a random version instead", cookie.Value)
-				modifyRequest(settings, req, versions.getRandomVersion())
-			}
-		} else {
-			logger.Printf("new request, using random version")
-			modifyRequest(settings, req, versions.getRandomVersion())
+		experiment, err := newExperiment(settings, e.Name, e.Versions, e.Window, e.Bandit)
+		if err != nil {
+			revaboxy.Close()
+			return nil, err
 		}
+		if e.Salt != "" {
+			experiment.salt = e.Salt
+		}
+		scope := e.Scope
+		experiment.scope = &scope
+		experiment.targeting = e.Targeting
+		revaboxy.experiments = append(revaboxy.experiments, experiment)
+	}
+
+	revaboxy.routing = append(append([]*experiment{}, revaboxy.experiments[1:]...), main)
+
+	// The director changes the request to target the version that was assigned in ServeHTTP
+	// and adds the headers with the assigned versions of all experiments
+	director := func(req *http.Request) {
+		state := getRequestState(req.Context())
+		modifyRequest(req, state.target.url)
+		settings.setVersionHeaders(req, state)
 	}
 
 	// Add a cookie to the response that tracks which version the user got
 	// so that the following requests will use the same version
 	modifyResponse := func(r *http.Response) error {
-		name := r.Request.Header.Get(settings.headerName)
-		existingCookie, _ := r.Request.Cookie(settings.cookieName)
+		state := getRequestState(r.Request.Context())
+
+		// Let the error handler retry the request against the default version if the response is treated as a failure
+		if p := settings.failoverPolicy; p != nil && state.retryable && state.route.version.Name != DefaultName && p.failure(r.StatusCode) {
+			return &failoverStatusError{statusCode: r.StatusCode}
+		}
+
+		if b := state.route.experiment.bandit; b != nil {
+			b.rewardResponse(state.route, r)
+		}
+		if settings.goals != nil {
+			settings.reachResponseGoals(state, r)
+		}
+		settings.setResponseHeaders(r.Header, state, false)
 
-		if name != "" && (existingCookie == nil || versions.get(existingCookie.Value) == nil) {
+		for _, a := range state.assignments {
+			if !a.setCookie {
+				continue
+			}
+			name := a.experiment.cookieName
+			if a.kind == AssignmentOverride {
+				name = a.experiment.overrideCookieName
+			}
 			newCookie := &http.Cookie{
-				Name:    settings.cookieName,
-				Value:   name,
-				Path:    "/",
-				Expires: time.Now().Add(settings.cookieExpiry),
+				Name:     name,
+				Value:    settings.encodeCookieValue(a.version.Name),
+				Path:     "/",
+				Expires:  time.Now().Add(settings.cookieExpiry),
+				HttpOnly: settings.cookieHTTPOnly,
 			}
 			r.Header.Add("Set-Cookie", newCookie.String())
 		}
@@ -154,34 +307,223 @@ func New(vv []Version, settingChangers ...Setting) (*Revaboxy, error) {
 		return nil
 	}
 
-	// Make sure a failed request (by not reaching the host) to a version that is not
-	// the default one is redirected to the default one
-	defaultReverseProxy := httputil.NewSingleHostReverseProxy(versions[DefaultName].URL)
-	defaultReverseProxy.Transport = settings.roundTripper
+	// Make sure a failed request (by not reaching the host, or by a status code treated as failure by the failover policy)
+	// to a version that is not the default one is redirected to the default one
 	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
-		name := r.Header.Get(settings.headerName)
-		if name != "" && name != DefaultName {
-			logger.Printf("could not connect to %s, using default instead: %s", name, err)
+		state := getRequestState(r.Context())
+		state.target.eject(settings.ejectionDuration)
+
+		route := state.route
+		if name := route.version.Name; name != DefaultName {
+			var statusErr *failoverStatusError
+			if errors.As(err, &statusErr) {
+				route.experiment.logf(settings, "%s %s, using default instead", name, statusErr)
+			} else {
+				route.experiment.logf(settings, "could not connect to %s, using default instead: %s", name, err)
+			}
+			settings.metrics.IncCounter(MetricFailovers, route.experiment.labels(name))
+			settings.events.recordFailover(r, state)
+			if settings.failoverPolicy != nil {
+				w.Header().Set(settings.failoverPolicy.Header, name)
+			}
+			settings.setResponseHeaders(w.Header(), state, true)
+			state.retryBody(r)
+
+			defaultVersion := route.versions[DefaultName]
+			r = withVersion(r, defaultVersion)
+			defaultTarget := defaultVersion.balancer.pick()
+			if defaultTarget == nil {
+				route.experiment.logf(settings, "%s has no url or handler to send the request to", DefaultName)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer defaultTarget.done()
+			if defaultTarget.handler != nil {
+				*r.URL = state.url
+				r.Header.Set(route.experiment.headerName, DefaultName)
+				if err := settings.serveHandler(w, r, defaultTarget.handler, nil); err != nil {
+					route.experiment.logf(settings, "the default version failed: %s", err)
+					w.WriteHeader(http.StatusBadGateway)
+				}
+				return
+			}
+			defaultReverseProxy := &httputil.ReverseProxy{
+				Director: func(req *http.Request) {
+					*req.URL = state.url
+					modifyRequest(req, defaultTarget.url)
+					req.Header.Set(route.experiment.headerName, DefaultName)
+				},
+				// The failover has already been logged, so only the failing target is ejected
+				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+					defaultTarget.eject(settings.ejectionDuration)
+					w.WriteHeader(http.StatusBadGateway)
+				},
+				Transport: transport,
+			}
 			defaultReverseProxy.ServeHTTP(w, r)
 			return
 		}
 
-		logger.Printf("could not connect to the default version: %s", err)
+		route.experiment.logf(settings, "could not connect to the default version: %s", err)
 		w.WriteHeader(http.StatusBadGateway)
 	}
 
-	return &Revaboxy{
-		reverseProxy: &httputil.ReverseProxy{
-			Director:       director,
-			ModifyResponse: modifyResponse,
-			ErrorHandler:   errorHandler,
-			Transport:      settings.roundTripper,
-		},
-	}, nil
+	revaboxy.reverseProxy = &httputil.ReverseProxy{
+		Director:       director,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		Transport:      transport,
+	}
+	return revaboxy, nil
+}
+
+// UpdateVersions validates and replaces the versions of the main experiment
+// Requests that are already being handled will finish with the versions they started with.
+// Users that has been assigned a version that still exists will keep it
+func (revaboxy *Revaboxy) UpdateVersions(vv []Version) error {
+	return revaboxy.UpdateExperimentVersions("", vv)
+}
+
+// UpdateExperimentVersions validates and replaces the versions of an experiment added with WithExperiment,
+// the main experiment is updated if the name is empty
+func (revaboxy *Revaboxy) UpdateExperimentVersions(name string, vv []Version) error {
+	e, err := revaboxy.experiment(name)
+	if err != nil {
+		return err
+	}
+	if err := e.update(vv); err != nil {
+		return err
+	}
+	e.logf(revaboxy.settings, "updated to %d versions", len(vv))
+	return nil
+}
+
+// UpdateAllVersions validates the versions of the main experiment and of the experiments added with WithExperiment,
+// and replaces them only if all of them are valid, so that an invalid configuration is not partially applied
+func (revaboxy *Revaboxy) UpdateAllVersions(vv []Version, experiments []Experiment) error {
+	main := revaboxy.experiments[0]
+	mainVersions, err := main.newVersions(vv)
+	if err != nil {
+		return err
+	}
+
+	updated := make([]*experiment, len(experiments))
+	updatedVersions := make([]versions, len(experiments))
+	for i, ex := range experiments {
+		if ex.Name == "" {
+			return errors.New("all experiments needs to have a name")
+		}
+		if updated[i], err = revaboxy.experiment(ex.Name); err != nil {
+			return err
+		}
+		if updatedVersions[i], err = updated[i].newVersions(ex.Versions); err != nil {
+			return err
+		}
+	}
+
+	main.apply(mainVersions)
+	main.logf(revaboxy.settings, "updated to %d versions", len(vv))
+	for i, e := range updated {
+		e.apply(updatedVersions[i])
+		e.logf(revaboxy.settings, "updated to %d versions", len(experiments[i].Versions))
+	}
+	return nil
+}
+
+// experiment finds an experiment by its name, the main experiment has an empty name
+func (revaboxy *Revaboxy) experiment(name string) (*experiment, error) {
+	for _, e := range revaboxy.experiments {
+		if e.name == name {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find the experiment \"%s\"", name)
+}
+
+// Close stops all background work, like health checks
+func (revaboxy *Revaboxy) Close() error {
+	for _, e := range revaboxy.experiments {
+		e.health.close()
+		e.bandit.close()
+		e.sampleRatio.close()
+	}
+	err := revaboxy.settings.events.close()
+	if storeErr := revaboxy.settings.closeStore(); err == nil {
+		err = storeErr
+	}
+	return err
+}
+
+// assign assigns versions for all experiments, and selects the experiment that decides where the request is sent
+// Versions forced by an override are used ahead of the cookies and targeting
+func (revaboxy *Revaboxy) assign(req *http.Request, forced *overrides) *requestState {
+	settings := revaboxy.settings
+
+	state := &requestState{
+		url: *req.URL,
+	}
+
+	for _, e := range revaboxy.routing {
+		var a *assignment
+		if e.inScope(req) {
+			a = e.assignInScope(settings, req, forced)
+			if state.route == nil {
+				state.route = a
+			}
+		} else if e.name == "" {
+			// Requests outside the scope of the main experiment always use the default version,
+			// unless another experiment decides where the request is sent
+			a = e.useDefault(settings, "request is out of scope")
+			if state.route == nil {
+				state.route = a
+			}
+		} else {
+			a = e.existing(settings, req)
+		}
+
+		if a != nil {
+			state.assignments = append(state.assignments, a)
+		}
+	}
+
+	return state
+}
+
+// setVersionHeaders sets the headers with the assigned versions of all experiments on a request sent to a version,
+// and records the assignments in the event log
+func (s *settings) setVersionHeaders(req *http.Request, state *requestState) {
+	// Any values of the headers that might have been sent by the client are removed
+	for _, headerName := range s.headerNames() {
+		req.Header.Del(headerName)
+	}
+	for _, a := range state.assignments {
+		req.Header.Set(a.experiment.headerName, a.version.Name)
+	}
+	s.events.recordAssignments(req, state)
 }
 
-func modifyRequest(s *settings, req *http.Request, targetVersion *Version) {
-	url := targetVersion.URL
+// setResponseHeaders sets the response headers with the versions used for all experiments, if they are enabled
+// The default version is used for the experiment that decides where the request is sent if the request failed over
+func (s *settings) setResponseHeaders(header http.Header, state *requestState, failover bool) {
+	if s.responseHeader == "" {
+		return
+	}
+	for _, a := range state.assignments {
+		name := a.version.Name
+		if failover && a == state.route {
+			name = DefaultName
+		}
+		headerName := s.responseHeader
+		if a.experiment.name != "" {
+			headerName = http.CanonicalHeaderKey(s.responseHeader + "-" + a.experiment.name)
+		}
+		header.Set(headerName, name)
+	}
+}
+
+// modifyRequest changes the request to be sent to targetURL, which is one of the urls of a version
+func modifyRequest(req *http.Request, targetURL *url.URL) {
+	url := targetURL
 	targetQuery := url.RawQuery
 
 	req.URL.Scheme = url.Scheme
@@ -196,14 +538,60 @@ func modifyRequest(s *settings, req *http.Request, targetVersion *Version) {
 		// explicitly disable User-Agent so it's not set to default value
 		req.Header.Set("User-Agent", "")
 	}
-
-	req.Header.Add(s.headerName, targetVersion.Name)
 }
 
 func (revaboxy *Revaboxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, state := revaboxy.assignRequest(w, r)
+	if state == nil {
+		return
+	}
+	state.target = state.route.version.balancer.pick()
+	if state.target == nil {
+		state.route.experiment.logf(revaboxy.settings, "%s has no url or handler to send the request to", state.route.version.Name)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer state.target.done()
+
+	if p := revaboxy.settings.failoverPolicy; p != nil && state.route.version.Name != DefaultName {
+		if err := state.prepareRetry(p, r); err != nil {
+			revaboxy.settings.logger.Printf("could not read the request body: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if state.target.handler != nil {
+		revaboxy.serveVersionHandler(w, r, state)
+		return
+	}
 	revaboxy.reverseProxy.ServeHTTP(w, r)
 }
 
+// assignRequest assigns the versions of a request, and returns the request with the state in its context
+// Requests to the goal endpoint, and requests rejected since the version header was spoofed, are answered and nil is returned
+func (revaboxy *Revaboxy) assignRequest(w http.ResponseWriter, r *http.Request) (*http.Request, *requestState) {
+	if g := revaboxy.settings.goals; g != nil && strings.HasPrefix(r.URL.Path, g.Path) {
+		revaboxy.serveGoal(w, r)
+		return r, nil
+	}
+
+	// The version header is owned by revaboxy, any value sent by the client is replaced in the director
+	if !revaboxy.settings.checkSpoofedHeader(w, r) {
+		return r, nil
+	}
+
+	var forced *overrides
+	if o := revaboxy.settings.override; o != nil {
+		forced = o.forced(revaboxy.settings, r)
+		r = o.strip(r)
+	}
+
+	state := revaboxy.assign(r, forced)
+	r = r.WithContext(context.WithValue(r.Context(), requestStateKey{}, state))
+	return withVersion(r, state.route.version), state
+}
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
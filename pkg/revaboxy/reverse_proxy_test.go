@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,20 +23,105 @@ func mustURLParse(s string) *url.URL {
 	return u
 }
 
+// testVersions are a default version, and a green version that all new users are assigned
+func testVersions() []Version {
+	return []Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 0,
+		},
+		{
+			Name:        "green",
+			URL:         mustURLParse("http://green.test"),
+			Probability: 1,
+		},
+	}
+}
+
+// testExperiment is an experiment of the requests to /checkout, where all new users are assigned one-click
+func testExperiment() Experiment {
+	return Experiment{
+		Name: "checkout",
+		Versions: []Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://checkout.test"),
+				Probability: 0,
+			},
+			{
+				Name:        "one-click",
+				URL:         mustURLParse("http://checkout-one-click.test"),
+				Probability: 1,
+			},
+		},
+		Scope: Scope{
+			PathPrefixes: []string{"/checkout"},
+		},
+	}
+}
+
+// testRoundTripper answers the requests to the hosts in hostAnswer, requests to other hosts fails
+// The status code and headers of the responses can be set per host, and the requests are saved
 type testRoundTripper struct {
 	hostAnswer map[string]string
+	// The status code of the responses from each host, 200 if not set
+	hostStatus map[string]int
+	// The headers of the responses from each host
+	hostHeader map[string]http.Header
+
+	mu sync.Mutex
+	// The body of the last request to each host
+	bodies map[string]string
+	// The name of the version in the context of every request
+	versions []string
+}
+
+func (rt *testRoundTripper) setStatus(host string, status int) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.hostStatus == nil {
+		rt.hostStatus = map[string]int{}
+	}
+	rt.hostStatus[host] = status
 }
 
 func (rt *testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	answer, ok := rt.hostAnswer[req.URL.Host]
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	host := req.URL.Host
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		if rt.bodies == nil {
+			rt.bodies = map[string]string{}
+		}
+		rt.bodies[host] = string(body)
+	}
+	name := ""
+	if v := VersionFromContext(req.Context()); v != nil {
+		name = v.Name
+	}
+	rt.versions = append(rt.versions, name)
+
+	answer, ok := rt.hostAnswer[host]
 	if !ok {
 		return nil, errors.New("could not find host")
 	}
+
+	status, ok := rt.hostStatus[host]
+	if !ok {
+		status = http.StatusOK
+	}
+	header := rt.hostHeader[host].Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
 	return &http.Response{
-		Header:     make(http.Header),
+		Header:     header,
 		Request:    req,
 		Body:       ioutil.NopCloser(strings.NewReader(answer)),
-		StatusCode: http.StatusOK,
+		StatusCode: status,
 	}, nil
 }
 
@@ -260,10 +346,6 @@ func TestNew(t *testing.T) {
 }
 
 func Test_modifyRequestUrl(t *testing.T) {
-	settings := &settings{
-		headerName: "test",
-	}
-
 	tests := []struct {
 		name    string
 		reqURL  string
@@ -334,7 +416,7 @@ func Test_modifyRequestUrl(t *testing.T) {
 				t.Fatal("could not parse url", err)
 			}
 
-			modifyRequest(settings, req, tt.version)
+			modifyRequest(req, tt.version.URL)
 
 			if *req.URL != *tt.wantURL {
 				t.Errorf("modifyRequest url = %s, wantURL = %s", req.URL.String(), tt.wantURL.String())
@@ -474,3 +556,311 @@ func Test_WithCookieExpiry(t *testing.T) {
 		t.Fatalf(`expected cookie to have expiry set correctly`)
 	}
 }
+
+func TestSpoofedHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     SpoofedHeaderPolicy
+		wantStatus int
+		wantLogs   int
+	}{
+		{
+			name:       "strip",
+			policy:     StripSpoofedHeader,
+			wantStatus: http.StatusOK,
+			wantLogs:   0,
+		},
+		{
+			name:       "log",
+			policy:     LogSpoofedHeader,
+			wantStatus: http.StatusOK,
+			wantLogs:   1,
+		},
+		{
+			name:       "reject",
+			policy:     RejectSpoofedHeader,
+			wantStatus: http.StatusBadRequest,
+			wantLogs:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &savingRoundtripper{}
+			l := &testLogger{}
+
+			proxy, err := New(
+				[]Version{
+					{
+						Name:        DefaultName,
+						URL:         mustURLParse("http://example.com"),
+						Probability: 1,
+					},
+					{
+						Name:        "green",
+						URL:         mustURLParse("http://example.com"),
+						Probability: 0,
+					},
+				},
+				WithTransport(rt),
+				WithSpoofedHeaderPolicy(tt.policy),
+				WithLogger(l),
+			)
+			if err != nil {
+				t.Fatal("should not error when creating revaboxy")
+			}
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.Header.Add("Revaboxy-Name", "green")
+			req.Header.Add("Revaboxy-Name", "green")
+			proxy.settings.checkSpoofedHeader(rec, req)
+
+			if real := l.logs; real != tt.wantLogs {
+				t.Fatalf("expected %d logs, got %d", tt.wantLogs, real)
+			}
+
+			rec = httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			if real := rec.Code; real != tt.wantStatus {
+				t.Fatalf("expected status code %d, got %d", tt.wantStatus, real)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if real, expected := rt.req.Header.Values("Revaboxy-Name"), []string{DefaultName}; len(real) != 1 || real[0] != expected[0] {
+				t.Fatalf("expected the header to be %v, got %v", expected, real)
+			}
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Value != DefaultName {
+				t.Fatalf("expected a cookie with the value %s, got %v", DefaultName, cookies)
+			}
+		})
+	}
+}
+
+func TestUpdateVersions(t *testing.T) {
+	rt := &testRoundTripper{
+		hostAnswer: map[string]string{
+			"default.test": "default-data",
+			"green.test":   "green-data",
+			"blue.test":    "blue-data",
+		},
+	}
+
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 0,
+			},
+			{
+				Name:        "green",
+				URL:         mustURLParse("http://green.test"),
+				Probability: 1,
+			},
+		},
+		WithTransport(rt),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	request := func(cookieValue string) string {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if cookieValue != "" {
+			req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: cookieValue})
+		}
+		proxy.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	if real, expected := request(""), "green-data"; real != expected {
+		t.Fatalf("expected %s, got %s", expected, real)
+	}
+
+	// Invalid versions should not replace the current ones
+	err = proxy.UpdateVersions([]Version{
+		{
+			Name:        "blue",
+			URL:         mustURLParse("http://blue.test"),
+			Probability: 1,
+		},
+	})
+	if err == nil {
+		t.Fatal("expected an error when updating without a default version")
+	}
+	if real, expected := request(""), "green-data"; real != expected {
+		t.Fatalf("expected %s, got %s", expected, real)
+	}
+
+	err = proxy.UpdateVersions([]Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 0,
+		},
+		{
+			Name:        "green",
+			URL:         mustURLParse("http://green.test"),
+			Probability: 0,
+		},
+		{
+			Name:        "blue",
+			URL:         mustURLParse("http://blue.test"),
+			Probability: 1,
+		},
+	})
+	if err != nil {
+		t.Fatal("could not update versions", err)
+	}
+
+	if real, expected := request(""), "blue-data"; real != expected {
+		t.Fatalf("expected new users to get %s, got %s", expected, real)
+	}
+	if real, expected := request("green"), "green-data"; real != expected {
+		t.Fatalf("expected users with an existing version to keep it and get %s, got %s", expected, real)
+	}
+}
+
+func TestUpdateVersionsConcurrently(t *testing.T) {
+	vv := []Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 0.5,
+		},
+		{
+			Name:        "green",
+			URL:         mustURLParse("http://green.test"),
+			Probability: 0.5,
+		},
+	}
+
+	proxy, err := New(vv, WithTransport(&testRoundTripper{
+		hostAnswer: map[string]string{
+			"default.test": "default-data",
+			"green.test":   "green-data",
+		},
+	}))
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := proxy.UpdateVersions(vv); err != nil {
+				t.Error("could not update versions", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		proxy.ServeHTTP(rec, req)
+		if real, expected := rec.Code, http.StatusOK; real != expected {
+			t.Fatalf("expected status code %v, got %v", expected, real)
+		}
+	}
+	<-done
+}
+
+func TestVersionFromContext(t *testing.T) {
+	rt := &testRoundTripper{
+		hostAnswer: map[string]string{
+			"default.test": "default-data",
+		},
+	}
+	proxy, err := New(testVersions(), WithTransport(rt))
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	proxy.ServeHTTP(rec, req)
+
+	// green can not be reached, so the request is sent to the default version
+	if real, expected := strings.Join(rt.versions, ","), "green,default"; real != expected {
+		t.Errorf("expected the versions %s in the context, got %s", expected, real)
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		hosts       []string
+		wantHeaders map[string]string
+	}{
+		{
+			name:  "main experiment",
+			path:  "/",
+			hosts: []string{"green.test"},
+			wantHeaders: map[string]string{
+				"X-Revaboxy-Version":          "green",
+				"X-Revaboxy-Version-Checkout": "",
+			},
+		},
+		{
+			name:  "experiments",
+			path:  "/checkout",
+			hosts: []string{"checkout-one-click.test"},
+			wantHeaders: map[string]string{
+				"X-Revaboxy-Version":          "green",
+				"X-Revaboxy-Version-Checkout": "one-click",
+			},
+		},
+		{
+			name:  "failover",
+			path:  "/",
+			hosts: []string{"default.test"},
+			wantHeaders: map[string]string{
+				"X-Revaboxy-Version": DefaultName,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &testRoundTripper{hostAnswer: map[string]string{}}
+			for _, host := range tt.hosts {
+				rt.hostAnswer[host] = host
+			}
+			proxy, err := New(
+				testVersions(),
+				WithTransport(rt),
+				WithExperiment(testExperiment()),
+				WithResponseHeader("X-Revaboxy-Version"),
+				WithCookieHTTPOnly(true),
+			)
+			if err != nil {
+				t.Fatal("could not create proxy", err)
+			}
+			defer proxy.Close()
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			proxy.ServeHTTP(rec, req)
+
+			resp := rec.Result()
+			for name, expected := range tt.wantHeaders {
+				if real := resp.Header.Get(name); real != expected {
+					t.Errorf("expected the header %s to be %q, got %q", name, expected, real)
+				}
+			}
+			for _, cookie := range resp.Cookies() {
+				if !cookie.HttpOnly {
+					t.Errorf("expected the cookie %s to be HttpOnly", cookie.Name)
+				}
+			}
+		})
+	}
+}
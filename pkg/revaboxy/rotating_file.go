@@ -0,0 +1,146 @@
+package revaboxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// EventFile is where a RotatingFile writes events
+type EventFile struct {
+	// The path of the file, rotated files are named with a number after it, like "events.jsonl.1", the lowest number being the newest
+	Path string
+	// The size in bytes that the file is rotated at, defaults to 100 MB
+	MaxSize int64
+	// The number of rotated files that are kept, defaults to 5
+	MaxFiles int
+}
+
+// RotatingFile is an EventSink that writes the events as one JSON object per line, and rotates the file when it reaches the max size
+// It should be created with NewRotatingFile
+type RotatingFile struct {
+	config EventFile
+
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+// NewRotatingFile opens the file, events are appended if it already exists
+func NewRotatingFile(config EventFile) (*RotatingFile, error) {
+	if config.Path == "" {
+		return nil, errors.New("the event file needs a path")
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100 << 20
+	}
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = 5
+	}
+
+	f := &RotatingFile{config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open the event file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not open the event file: %s", err)
+	}
+	f.file = file
+	f.buf = bufio.NewWriter(file)
+	f.size = info.Size()
+	return nil
+}
+
+// WriteEvent writes the event to the file, the file is rotated first if the event would make it larger than the max size
+func (f *RotatingFile) WriteEvent(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if f.size > 0 && f.size+int64(len(line)) > f.config.MaxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.buf.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// Flush writes the buffered events to the file
+func (f *RotatingFile) Flush() error {
+	return f.buf.Flush()
+}
+
+// Close writes the buffered events and closes the file
+func (f *RotatingFile) Close() error {
+	err := f.buf.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotate renames the file to the first rotated file, the other rotated files are shifted and the oldest is removed
+// The current file is only closed when the new one has been opened, so that the events can still be written if the rotation fails.
+// If only the opening failed, the file has already been renamed and is not shifted again when the rotation is retried
+func (f *RotatingFile) rotate() error {
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+
+	path := f.config.Path
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Remove(rotatedName(path, f.config.MaxFiles)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := f.config.MaxFiles - 1; i >= 1; i-- {
+			if err := os.Rename(rotatedName(path, i), rotatedName(path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(path, rotatedName(path, 1)); err != nil {
+			return err
+		}
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func rotatedName(path string, i int) string {
+	return path + "." + strconv.Itoa(i)
+}
+
+// EventFiles returns the existing files of the event file at path, including the rotated ones, with the oldest first
+func EventFiles(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedName(path, i)); err != nil {
+			break
+		}
+		files = append([]string{rotatedName(path, i)}, files...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
@@ -0,0 +1,115 @@
+package revaboxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revaboxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	// Every event is about 70 bytes, so each file fits two events
+	f, err := NewRotatingFile(EventFile{Path: path, MaxSize: 150, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, version := range versions {
+		if err := f.WriteEvent(Event{Type: EventAssignment, Version: version}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := EventFiles(path)
+	if expected := []string{path + ".2", path + ".1", path}; !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected the files %v, got %v", expected, files)
+	}
+
+	// The oldest file is removed, so the events of the first file are lost
+	var read []string
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ReadEvents(file, func(e Event) error {
+			read = append(read, e.Version)
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := versions[2:]; !reflect.DeepEqual(read, expected) {
+		t.Errorf("expected the events %v, got %v", expected, read)
+	}
+
+	// Events are appended to an existing file
+	f, err = NewRotatingFile(EventFile{Path: path, MaxSize: 150, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real, expected := f.size, int64(0); real <= expected {
+		t.Errorf("expected the size of the existing file to be used, got %d", real)
+	}
+	f.Close()
+}
+
+func TestRotatingFileFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revaboxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	f, err := NewRotatingFile(EventFile{Path: path, MaxSize: 100, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A directory that is not empty can not be removed to make room for the rotated file
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteEvent(Event{Type: EventAssignment, Version: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteEvent(Event{Type: EventAssignment, Version: "b"}); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+
+	// The file is still open, so the rotation succeeds when it is retried
+	os.RemoveAll(path + ".1")
+	if err := f.WriteEvent(Event{Type: EventAssignment, Version: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{path + ".1": "a", path: "b"} {
+		var read []string
+		data, _ := ioutil.ReadFile(name)
+		ReadEvents(bytes.NewReader(data), func(e Event) error {
+			read = append(read, e.Version)
+			return nil
+		})
+		if len(read) != 1 || read[0] != expected {
+			t.Errorf("expected the event %s in %s, got %v", expected, name, read)
+		}
+	}
+}
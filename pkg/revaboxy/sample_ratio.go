@@ -0,0 +1,305 @@
+package revaboxy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SampleRatioCheck detects sample ratio mismatches, when the split of new users between the versions drifts from the expected split,
+// e.g. because users of one version retries after errors. The results of an experiment with a mismatch can not be trusted
+//
+// The new users in a rolling window are compared to the expected split with a chi-square test. The expected split follows
+// the probabilities and schedules of the versions, or the allocation of the bandit mode.
+// A mismatch is logged, counted in MetricSampleRatioMismatches and shown in the status
+type SampleRatioCheck struct {
+	// The p-value below which the split is treated as a mismatch, defaults to 0.001
+	Threshold float64
+	// How often the test is run, defaults to 1m
+	Interval time.Duration
+	// The rolling window of new users that are tested, defaults to 1h
+	Window time.Duration
+	// The minimum number of new users in the window to run the test, defaults to 100
+	MinUsers uint64
+}
+
+// WithSampleRatioCheck checks all experiments for sample ratio mismatches
+func WithSampleRatioCheck(c SampleRatioCheck) Setting {
+	return func(s *settings) {
+		s.sampleRatioCheck = &c
+	}
+}
+
+func (c SampleRatioCheck) withDefaults() SampleRatioCheck {
+	if c.Threshold == 0 {
+		c.Threshold = 0.001
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Minute
+	}
+	if c.Window <= 0 {
+		c.Window = time.Hour
+	}
+	if c.MinUsers == 0 {
+		c.MinUsers = 100
+	}
+	return c
+}
+
+func (c *SampleRatioCheck) validate() error {
+	if c.Threshold < 0 || c.Threshold >= 1 {
+		return fmt.Errorf("the threshold of the sample ratio check needs to be between 0 and 1")
+	}
+	if c.Window > 0 && c.Interval > c.Window {
+		return fmt.Errorf("the window of the sample ratio check needs to be at least as long as the interval")
+	}
+	return nil
+}
+
+// SampleRatioStatus is the result of the last sample ratio check of an experiment
+type SampleRatioStatus struct {
+	// The p-value of the chi-square test, and if it is below the threshold
+	PValue   float64 `json:"p_value"`
+	Mismatch bool    `json:"mismatch"`
+	// The observed and expected number of new users of each version in the window
+	Observed  map[string]uint64  `json:"observed"`
+	Expected  map[string]float64 `json:"expected"`
+	CheckedAt time.Time          `json:"checked_at"`
+}
+
+// sampleRatioBucket is the new users during one interval
+type sampleRatioBucket struct {
+	start    time.Time
+	observed map[string]uint64
+	expected map[string]float64
+}
+
+// sampleRatio is the running sample ratio check of an experiment
+type sampleRatio struct {
+	settings   *settings
+	experiment *experiment
+	config     SampleRatioCheck
+
+	mu sync.Mutex
+	// The buckets in the window, the newest last
+	buckets []*sampleRatioBucket
+
+	// The result of the last test, *SampleRatioStatus
+	status atomic.Value
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSampleRatio(s *settings, e *experiment, config SampleRatioCheck) *sampleRatio {
+	sr := &sampleRatio{
+		settings:   s,
+		experiment: e,
+		config:     config.withDefaults(),
+	}
+	sr.status.Store((*SampleRatioStatus)(nil))
+	return sr
+}
+
+// start runs the test every interval, until the check is closed
+func (sr *sampleRatio) start() {
+	sr.stop = make(chan struct{})
+	sr.wg.Add(1)
+	go func() {
+		defer sr.wg.Done()
+
+		ticker := time.NewTicker(sr.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sr.check(now)
+			case <-sr.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (sr *sampleRatio) close() {
+	if sr == nil || sr.stop == nil {
+		return
+	}
+	close(sr.stop)
+	sr.wg.Wait()
+	sr.stop = nil
+}
+
+// observe records a new user of the version, shares are the probabilities of all versions when the user was assigned
+func (sr *sampleRatio) observe(version string, shares map[string]float64, now time.Time) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	var bucket *sampleRatioBucket
+	if n := len(sr.buckets); n > 0 && now.Sub(sr.buckets[n-1].start) < sr.config.Interval {
+		bucket = sr.buckets[n-1]
+	} else {
+		bucket = &sampleRatioBucket{
+			start:    now,
+			observed: map[string]uint64{},
+			expected: map[string]float64{},
+		}
+		sr.buckets = append(sr.buckets, bucket)
+	}
+
+	bucket.observed[version]++
+	for name, share := range shares {
+		bucket.expected[name] += share
+	}
+}
+
+// check runs the chi-square test on the new users in the window, and logs and counts the result if it has changed
+func (sr *sampleRatio) check(now time.Time) *SampleRatioStatus {
+	sr.mu.Lock()
+	// Remove the buckets that has passed the window
+	i := 0
+	for i < len(sr.buckets) && now.Sub(sr.buckets[i].start) >= sr.config.Window {
+		i++
+	}
+	sr.buckets = sr.buckets[i:]
+
+	observed := map[string]uint64{}
+	expected := map[string]float64{}
+	total := uint64(0)
+	for _, b := range sr.buckets {
+		for name, n := range b.observed {
+			observed[name] += n
+			total += n
+		}
+		for name, e := range b.expected {
+			expected[name] += e
+		}
+	}
+	sr.mu.Unlock()
+
+	if total < sr.config.MinUsers {
+		return sr.getStatus()
+	}
+
+	chiSquare := 0.0
+	degrees := -1
+	for name, e := range expected {
+		if e <= 0 {
+			continue
+		}
+		diff := float64(observed[name]) - e
+		chiSquare += diff * diff / e
+		degrees++
+	}
+	pValue := 1.0
+	if degrees > 0 {
+		pValue = chiSquarePValue(chiSquare, degrees)
+	}
+
+	status := &SampleRatioStatus{
+		PValue:    pValue,
+		Mismatch:  pValue < sr.config.Threshold,
+		Observed:  observed,
+		Expected:  expected,
+		CheckedAt: now,
+	}
+	previous := sr.getStatus()
+	sr.status.Store(status)
+
+	e := sr.experiment
+	switch {
+	case status.Mismatch && (previous == nil || !previous.Mismatch):
+		e.logf(sr.settings, "warning: sample ratio mismatch with the p-value %.6f, the split of new users is %s but %s was expected",
+			pValue, formatSplit(observed), formatSplit(expected))
+		labels := map[string]string{}
+		if e.name != "" {
+			labels[LabelExperiment] = e.name
+		}
+		sr.settings.metrics.IncCounter(MetricSampleRatioMismatches, labels)
+	case !status.Mismatch && previous != nil && previous.Mismatch:
+		e.logf(sr.settings, "the sample ratio mismatch has been resolved, the p-value is %.6f", pValue)
+	}
+	return status
+}
+
+func (sr *sampleRatio) getStatus() *SampleRatioStatus {
+	return sr.status.Load().(*SampleRatioStatus)
+}
+
+// formatSplit formats the number of users of each version, like "default=120 green=80"
+func formatSplit(split interface{}) string {
+	var parts []string
+	switch split := split.(type) {
+	case map[string]uint64:
+		for name, n := range split {
+			parts = append(parts, fmt.Sprintf("%s=%d", name, n))
+		}
+	case map[string]float64:
+		for name, n := range split {
+			parts = append(parts, fmt.Sprintf("%s=%.1f", name, n))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// chiSquarePValue is the probability of a chi-square value of at least x with the degrees of freedom
+func chiSquarePValue(x float64, degrees int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return upperIncompleteGamma(float64(degrees)/2, x/2)
+}
+
+// upperIncompleteGamma is the regularized upper incomplete gamma function Q(a, x),
+// calculated with a series for small x and a continued fraction otherwise
+func upperIncompleteGamma(a, x float64) float64 {
+	const (
+		iterations = 200
+		epsilon    = 1e-15
+	)
+	lgamma, _ := math.Lgamma(a)
+
+	if x < a+1 {
+		sum := 1 / a
+		term := sum
+		for n := 1; n < iterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*epsilon {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lgamma)
+	}
+
+	// Lentz's method for the continued fraction
+	tiny := 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < iterations; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lgamma) * h
+}
@@ -0,0 +1,121 @@
+package revaboxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type messageLogger struct {
+	messages []string
+}
+
+func (l *messageLogger) Printf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *messageLogger) contains(s string) bool {
+	for _, m := range l.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChiSquarePValue(t *testing.T) {
+	tests := []struct {
+		x       float64
+		degrees int
+		want    float64
+	}{
+		{x: 0, degrees: 1, want: 1},
+		{x: 3.841459, degrees: 1, want: 0.05},
+		{x: 10.827566, degrees: 1, want: 0.001},
+		{x: 5.991465, degrees: 2, want: 0.05},
+		{x: 1.386294, degrees: 2, want: 0.5},
+		{x: 30.577914, degrees: 15, want: 0.01},
+	}
+	for _, tt := range tests {
+		if real := chiSquarePValue(tt.x, tt.degrees); math.Abs(real-tt.want) > 1e-6 {
+			t.Errorf("chiSquarePValue(%v, %d) = %v, want %v", tt.x, tt.degrees, real, tt.want)
+		}
+	}
+}
+
+func TestSampleRatioCheck(t *testing.T) {
+	m := newTestMetrics()
+	logger := &messageLogger{}
+	proxy, err := New(
+		[]Version{
+			{Name: DefaultName, URL: mustURLParse("http://default.test")},
+			{Name: "green", URL: mustURLParse("http://green.test"), Probability: 0.5},
+		},
+		WithTransport(&savingRoundtripper{}),
+		WithMetrics(m),
+		WithLogger(logger),
+		WithSampleRatioCheck(SampleRatioCheck{Interval: time.Hour, Window: 2 * time.Hour, MinUsers: 10}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+	defer proxy.Close()
+	sr := proxy.experiments[0].sampleRatio
+
+	// The requests are assigned randomly, so the split is only checked to not be a mismatch
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		proxy.ServeHTTP(rec, req)
+	}
+	status := sr.check(time.Now())
+	if status == nil || status.Observed["default"]+status.Observed["green"] != 100 || status.Expected["green"] != 50 {
+		t.Fatalf("expected 100 observed users and 50 expected for green, got %+v", status)
+	}
+
+	// A new hour where green got many more users than expected
+	start := time.Now().Add(time.Hour)
+	shares := map[string]float64{DefaultName: 0.5, "green": 0.5}
+	for i := 0; i < 300; i++ {
+		version := "green"
+		if i%3 == 0 {
+			version = DefaultName
+		}
+		sr.observe(version, shares, start)
+	}
+	status = sr.check(start)
+	if !status.Mismatch || status.PValue > 0.001 {
+		t.Errorf("expected a mismatch, got %+v", status)
+	}
+	if real := proxy.Status()[0].SampleRatio; real != status {
+		t.Errorf("expected the status to contain the last check, got %+v", real)
+	}
+	if real, expected := m.counters["revaboxy_sample_ratio_mismatches_total{}"], 1; real != expected {
+		t.Errorf("expected %d mismatches to be counted, got %d", expected, real)
+	}
+	if !logger.contains("sample ratio mismatch") {
+		t.Error("expected the mismatch to be logged")
+	}
+
+	// Checking again does not count the same mismatch twice
+	sr.check(start)
+	if real, expected := m.counters["revaboxy_sample_ratio_mismatches_total{}"], 1; real != expected {
+		t.Errorf("expected %d mismatches to be counted, got %d", expected, real)
+	}
+
+	// The skewed users passes out of the window
+	for i := 0; i < 100; i++ {
+		version := "green"
+		if i%2 == 0 {
+			version = DefaultName
+		}
+		sr.observe(version, shares, start.Add(2*time.Hour))
+	}
+	if status := sr.check(start.Add(2 * time.Hour)); status.Mismatch {
+		t.Errorf("expected the mismatch to be resolved, got %+v", status)
+	}
+}
@@ -0,0 +1,78 @@
+package revaboxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Schedule changes the probability of a version over time, e.g. to gradually roll it out
+// The steps are anchored to absolute times, so the schedule continues where it should after a restart.
+// Before the first step, the Probability of the version is used
+type Schedule struct {
+	// The steps of the schedule, in time order
+	Steps []ScheduleStep `json:"steps"`
+	// Changes the probability linearly between the steps, instead of at the time of each step
+	Interpolate bool `json:"interpolate"`
+}
+
+// ScheduleStep is the probability of a version from a point in time
+type ScheduleStep struct {
+	At          time.Time `json:"at"`
+	Probability float64   `json:"probability"`
+}
+
+func (s *Schedule) validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("the schedule has no steps")
+	}
+	for i, step := range s.Steps {
+		if step.At.IsZero() {
+			return fmt.Errorf("step %d of the schedule has no time", i+1)
+		}
+		if i > 0 && !step.At.After(s.Steps[i-1].At) {
+			return fmt.Errorf("step %d of the schedule is not after the previous step", i+1)
+		}
+		if step.Probability < 0 || step.Probability > 1 {
+			return fmt.Errorf("step %d of the schedule has a probability outside of 0-1", i+1)
+		}
+	}
+	return nil
+}
+
+// probability returns the probability at the time t, or the initial probability if t is before the first step
+func (s *Schedule) probability(initial float64, t time.Time) float64 {
+	// The index of the first step after t
+	i := sort.Search(len(s.Steps), func(i int) bool {
+		return s.Steps[i].At.After(t)
+	})
+	switch {
+	case i == 0:
+		return initial
+	case i == len(s.Steps) || !s.Interpolate:
+		return s.Steps[i-1].Probability
+	}
+
+	from, to := s.Steps[i-1], s.Steps[i]
+	progress := float64(t.Sub(from.At)) / float64(to.At.Sub(from.At))
+	return from.Probability + (to.Probability-from.Probability)*progress
+}
+
+// next returns the first step after the time t, or nil if there is none
+func (s *Schedule) next(t time.Time) *ScheduleStep {
+	for _, step := range s.Steps {
+		if step.At.After(t) {
+			step := step
+			return &step
+		}
+	}
+	return nil
+}
+
+// probabilityAt returns the probability of the version at the time t, with its schedule taken into account
+func (v *Version) probabilityAt(t time.Time) float64 {
+	if v.Schedule == nil {
+		return v.Probability
+	}
+	return v.Schedule.probability(v.Probability, t)
+}
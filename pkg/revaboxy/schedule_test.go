@@ -0,0 +1,133 @@
+package revaboxy
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []ScheduleStep{
+		{At: start, Probability: 0.01},
+		{At: start.Add(24 * time.Hour), Probability: 0.1},
+		{At: start.Add(72 * time.Hour), Probability: 0.5},
+	}
+
+	tests := []struct {
+		name        string
+		interpolate bool
+		at          time.Time
+		want        float64
+	}{
+		{name: "before start", at: start.Add(-time.Hour), want: 0},
+		{name: "at start", at: start, want: 0.01},
+		{name: "first day", at: start.Add(12 * time.Hour), want: 0.01},
+		{name: "second step", at: start.Add(24 * time.Hour), want: 0.1},
+		{name: "after last step", at: start.Add(100 * time.Hour), want: 0.5},
+		{name: "interpolated", interpolate: true, at: start.Add(12 * time.Hour), want: 0.055},
+		{name: "interpolated at step", interpolate: true, at: start.Add(24 * time.Hour), want: 0.1},
+		{name: "interpolated between later steps", interpolate: true, at: start.Add(48 * time.Hour), want: 0.3},
+		{name: "interpolated after last step", interpolate: true, at: start.Add(100 * time.Hour), want: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Version{
+				Name:     "green",
+				Schedule: &Schedule{Steps: steps, Interpolate: tt.interpolate},
+			}
+			if real := v.probabilityAt(tt.at); math.Abs(real-tt.want) > 1e-9 {
+				t.Errorf("probabilityAt() = %v, want %v", real, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		versions []Version
+	}{
+		{
+			name: "no steps",
+			versions: []Version{
+				{Name: DefaultName},
+				{Name: "green", Schedule: &Schedule{}},
+			},
+		},
+		{
+			name: "unordered steps",
+			versions: []Version{
+				{Name: DefaultName},
+				{Name: "green", Schedule: &Schedule{Steps: []ScheduleStep{
+					{At: start.Add(time.Hour), Probability: 0.1},
+					{At: start, Probability: 0.2},
+				}}},
+			},
+		},
+		{
+			name: "invalid probability",
+			versions: []Version{
+				{Name: DefaultName},
+				{Name: "green", Schedule: &Schedule{Steps: []ScheduleStep{
+					{At: start, Probability: 1.1},
+				}}},
+			},
+		},
+		{
+			name: "total probability more than 1 later",
+			versions: []Version{
+				{Name: DefaultName},
+				{Name: "green", Probability: 0.5},
+				{Name: "blue", Schedule: &Schedule{Steps: []ScheduleStep{
+					{At: start, Probability: 0.4},
+					{At: start.Add(time.Hour), Probability: 0.6},
+				}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newVersions(tt.versions); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	now := time.Now()
+	proxy, err := New([]Version{
+		{
+			Name:        DefaultName,
+			URL:         mustURLParse("http://default.test"),
+			Probability: 0,
+		},
+		{
+			Name:        "green",
+			URL:         mustURLParse("http://green.test"),
+			Probability: 0.1,
+			Schedule: &Schedule{Steps: []ScheduleStep{
+				{At: now.Add(-time.Hour), Probability: 0.2},
+				{At: now.Add(time.Hour), Probability: 0.5},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	statuses := proxy.Status()
+	if len(statuses) != 1 || len(statuses[0].Versions) != 2 {
+		t.Fatalf("expected one experiment with two versions, got %+v", statuses)
+	}
+	def, green := statuses[0].Versions[0], statuses[0].Versions[1]
+	if math.Abs(def.Probability-0.8) > 1e-9 || math.Abs(green.Probability-0.2) > 1e-9 {
+		t.Errorf("expected the probabilities 0.8 and 0.2, got %v and %v", def.Probability, green.Probability)
+	}
+	if green.NextStep == nil || green.NextStep.Probability != 0.5 {
+		t.Errorf("expected the next step to have the probability 0.5, got %+v", green.NextStep)
+	}
+}
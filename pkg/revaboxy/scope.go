@@ -0,0 +1,105 @@
+package revaboxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Scope decides which requests an experiment applies to
+// A request is in scope if it matches the included hosts and paths, and does not match any of the excluded ones.
+// Requests outside the scope of the main experiment are sent to the default version without setting a cookie
+type Scope struct {
+	// The hosts that the experiment applies to, all hosts if empty. Globs like "*.example.com" may be used
+	Hosts []string
+	// The paths that the experiment applies to, all paths if PathPrefixes, PathGlobs and PathRegexps are empty
+	PathPrefixes []string
+	// Globs are matched against the whole path, like "/products/*/reviews". A "*" does not match "/"
+	PathGlobs   []string
+	PathRegexps []*regexp.Regexp
+
+	// Requests to any of these hosts or paths are not in scope, even if they match the included ones
+	ExcludeHosts        []string
+	ExcludePathPrefixes []string
+	ExcludePathGlobs    []string
+	ExcludePathRegexps  []*regexp.Regexp
+}
+
+// WithScope limits which requests the main experiment applies to
+func WithScope(scope Scope) Setting {
+	return func(s *settings) {
+		s.scope = &scope
+	}
+}
+
+// validate checks that all globs are valid
+func (s *Scope) validate() error {
+	for _, globs := range [][]string{s.Hosts, s.PathGlobs, s.ExcludeHosts, s.ExcludePathGlobs} {
+		for _, glob := range globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("invalid glob \"%s\" in scope", glob)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Scope) matches(req *http.Request) bool {
+	host := requestHost(req)
+	p := req.URL.Path
+
+	if len(s.Hosts) > 0 && !matchesHost(s.Hosts, host) {
+		return false
+	}
+	if (len(s.PathPrefixes) > 0 || len(s.PathGlobs) > 0 || len(s.PathRegexps) > 0) &&
+		!matchesPath(s.PathPrefixes, s.PathGlobs, s.PathRegexps, p) {
+		return false
+	}
+
+	return !matchesHost(s.ExcludeHosts, host) &&
+		!matchesPath(s.ExcludePathPrefixes, s.ExcludePathGlobs, s.ExcludePathRegexps, p)
+}
+
+func matchesHost(hosts []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		if ok, _ := path.Match(strings.ToLower(h), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPath(prefixes, globs []string, regexps []*regexp.Regexp, p string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	for _, re := range regexps {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the host of the request without any port
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
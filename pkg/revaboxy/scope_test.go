@@ -0,0 +1,208 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope Scope
+		url   string
+		want  bool
+	}{
+		{
+			name:  "empty",
+			scope: Scope{},
+			url:   "http://example.com/any/path",
+			want:  true,
+		},
+		{
+			name:  "path prefix",
+			scope: Scope{PathPrefixes: []string{"/api", "/checkout"}},
+			url:   "http://example.com/checkout/pay",
+			want:  true,
+		},
+		{
+			name:  "other path",
+			scope: Scope{PathPrefixes: []string{"/api", "/checkout"}},
+			url:   "http://example.com/static/app.js",
+			want:  false,
+		},
+		{
+			name:  "host with port",
+			scope: Scope{Hosts: []string{"Example.com"}},
+			url:   "http://example.com:8080/",
+			want:  true,
+		},
+		{
+			name:  "other host",
+			scope: Scope{Hosts: []string{"shop.example.com"}},
+			url:   "http://example.com/",
+			want:  false,
+		},
+		{
+			name:  "host and path",
+			scope: Scope{Hosts: []string{"example.com"}, PathPrefixes: []string{"/checkout"}},
+			url:   "http://example.com/",
+			want:  false,
+		},
+		{
+			name:  "host glob",
+			scope: Scope{Hosts: []string{"*.example.com"}},
+			url:   "http://shop.example.com/",
+			want:  true,
+		},
+		{
+			name:  "path glob",
+			scope: Scope{PathGlobs: []string{"/products/*/reviews"}},
+			url:   "http://example.com/products/42/reviews",
+			want:  true,
+		},
+		{
+			name:  "path glob does not match slash",
+			scope: Scope{PathGlobs: []string{"/products/*"}},
+			url:   "http://example.com/products/42/reviews",
+			want:  false,
+		},
+		{
+			name:  "path regexp",
+			scope: Scope{PathRegexps: []*regexp.Regexp{regexp.MustCompile(`^/(en|sv)/checkout`)}},
+			url:   "http://example.com/sv/checkout",
+			want:  true,
+		},
+		{
+			name:  "excluded path",
+			scope: Scope{ExcludePathPrefixes: []string{"/api", "/static"}},
+			url:   "http://example.com/static/app.js",
+			want:  false,
+		},
+		{
+			name: "excluded path within included",
+			scope: Scope{
+				PathPrefixes:     []string{"/checkout"},
+				ExcludePathGlobs: []string{"/checkout/*.js"},
+			},
+			url:  "http://example.com/checkout/app.js",
+			want: false,
+		},
+		{
+			name:  "excluded host",
+			scope: Scope{ExcludeHosts: []string{"admin.example.com"}},
+			url:   "http://admin.example.com/",
+			want:  false,
+		},
+		{
+			name:  "excluded path regexp",
+			scope: Scope{ExcludePathRegexps: []*regexp.Regexp{regexp.MustCompile(`\.(js|css)$`)}},
+			url:   "http://example.com/app.css",
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			if real := tt.scope.matches(req); real != tt.want {
+				t.Errorf("matches() = %v, want %v", real, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutOfScope(t *testing.T) {
+	rt := &savingRoundtripper{}
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 0,
+			},
+			{
+				Name:        "green",
+				URL:         mustURLParse("http://green.test"),
+				Probability: 1,
+			},
+		},
+		WithTransport(rt),
+		WithScope(Scope{PathPrefixes: []string{"/checkout"}}),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// Requests outside of the scope should go to default without a cookie, even if the user has another version
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/static/app.js", nil)
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: "green"})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "default.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real, expected := rt.req.Header.Get("Revaboxy-Name"), DefaultName; real != expected {
+		t.Fatalf("expected version %s, got %s", expected, real)
+	}
+	if real := len(rec.Result().Cookies()); real != 0 {
+		t.Fatalf("expected no cookies, got %d", real)
+	}
+
+	// Requests in scope should be assigned a version
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/checkout", nil)
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "green.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real := len(rec.Result().Cookies()); real != 1 {
+		t.Fatalf("expected one cookie, got %d", real)
+	}
+}
+
+func TestOutOfScopeOfMainExperiment(t *testing.T) {
+	rt := &savingRoundtripper{}
+	proxy, err := New(
+		testVersions(),
+		WithTransport(rt),
+		WithScope(Scope{ExcludePathPrefixes: []string{"/checkout"}}),
+		WithExperiment(testExperiment()),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// A path excluded from the main experiment should be sent to the experiment that has it in its scope
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/checkout", nil)
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "checkout-one-click.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real, expected := rt.req.Header.Get("Revaboxy-Name"), DefaultName; real != expected {
+		t.Fatalf("expected main version %s, got %s", expected, real)
+	}
+	if real, expected := rt.req.Header.Get("Revaboxy-Name-Checkout"), "one-click"; real != expected {
+		t.Fatalf("expected checkout version %s, got %s", expected, real)
+	}
+}
+
+func TestInvalidScope(t *testing.T) {
+	_, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 1,
+			},
+		},
+		WithScope(Scope{PathGlobs: []string{"/[checkout"}}),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
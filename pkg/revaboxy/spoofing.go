@@ -0,0 +1,57 @@
+package revaboxy
+
+import (
+	"net/http"
+)
+
+// SpoofedHeaderPolicy decides what happens to requests where the client has sent the version header itself
+// The header is always replaced or removed before the request reaches the downstream service
+type SpoofedHeaderPolicy int
+
+const (
+	// StripSpoofedHeader silently replaces the header sent by the client
+	StripSpoofedHeader SpoofedHeaderPolicy = iota
+	// LogSpoofedHeader replaces the header sent by the client and logs it
+	LogSpoofedHeader
+	// RejectSpoofedHeader responds with 400 Bad Request without passing the request on
+	RejectSpoofedHeader
+)
+
+// WithSpoofedHeaderPolicy sets what should happen with requests where the client has sent the version header
+// If the value is not set with this setting, it will default to StripSpoofedHeader
+func WithSpoofedHeaderPolicy(policy SpoofedHeaderPolicy) Setting {
+	return func(s *settings) {
+		s.spoofedHeaderPolicy = policy
+	}
+}
+
+// checkSpoofedHeader applies the spoofed header policy if the client has sent the version header of any experiment
+// false is returned if the request has been rejected and should not be handled further
+func (s *settings) checkSpoofedHeader(w http.ResponseWriter, r *http.Request) bool {
+	for _, headerName := range s.headerNames() {
+		values := r.Header.Values(headerName)
+		if len(values) == 0 {
+			continue
+		}
+
+		switch s.spoofedHeaderPolicy {
+		case LogSpoofedHeader:
+			s.logger.Printf("replacing the header %s sent by the client with the value %q", headerName, values)
+		case RejectSpoofedHeader:
+			s.logger.Printf("rejected request with the header %s sent by the client with the value %q", headerName, values)
+			http.Error(w, "the "+headerName+" header may not be set", http.StatusBadRequest)
+			return false
+		}
+	}
+
+	return true
+}
+
+// headerNames returns the version headers of all experiments
+func (s *settings) headerNames() []string {
+	names := []string{s.headerName}
+	for _, e := range s.experiments {
+		names = append(names, experimentHeaderName(s, e.Name))
+	}
+	return names
+}
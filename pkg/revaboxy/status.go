@@ -0,0 +1,99 @@
+package revaboxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Status is the current state of an experiment
+type Status struct {
+	// The name of the experiment, empty for the main experiment
+	Experiment string `json:"experiment,omitempty"`
+	// The phase of the experiment, "scheduled", "running" or "ended", and the time it is running
+	Phase    string          `json:"phase"`
+	Window   *Window         `json:"window,omitempty"`
+	Versions []VersionStatus `json:"versions"`
+	// The result of the last sample ratio check, if the experiment is checked and has had enough new users
+	SampleRatio *SampleRatioStatus `json:"sample_ratio,omitempty"`
+}
+
+// VersionStatus is the current state of a version
+type VersionStatus struct {
+	Name string `json:"name"`
+	// The current probability of a new user getting the version, the default version includes the rest of the probability
+	Probability float64 `json:"probability"`
+	// The schedule of the version, if it has one, and its next step
+	Schedule *Schedule     `json:"schedule,omitempty"`
+	NextStep *ScheduleStep `json:"next_step,omitempty"`
+	// The number of users assigned the version, and its rewards, in the bandit mode
+	Exposures uint64 `json:"exposures,omitempty"`
+	Rewards   uint64 `json:"rewards,omitempty"`
+	// The goals reached by the users of the version, by the name of the goal
+	Goals map[string]GoalStats `json:"goals,omitempty"`
+}
+
+// status returns the state of the experiment at the time t
+func (e *experiment) status(t time.Time) Status {
+	versions := e.getVersions()
+	phase := e.window.phaseAt(t)
+
+	// Everyone gets the same version before the start and after the end
+	var shares map[string]float64
+	switch {
+	case phase == phaseScheduled:
+		shares = map[string]float64{DefaultName: 1}
+	case phase == phaseEnded:
+		shares = map[string]float64{e.window.winner(): 1}
+	case e.bandit != nil:
+		shares = e.bandit.getShares()
+	default:
+		shares = versions.shares(t)
+	}
+
+	status := Status{
+		Experiment: e.name,
+		Phase:      phase.String(),
+		Window:     e.window,
+		Versions:   make([]VersionStatus, 0, len(versions)),
+	}
+	if e.sampleRatio != nil {
+		status.SampleRatio = e.sampleRatio.getStatus()
+	}
+	for _, name := range versions.names() {
+		v := versions[name]
+		vs := VersionStatus{
+			Name:        name,
+			Probability: shares[name],
+			Schedule:    v.Schedule,
+			Goals:       e.goals.get(name),
+		}
+		if v.Schedule != nil {
+			vs.NextStep = v.Schedule.next(t)
+		}
+		if e.bandit != nil {
+			arm := e.bandit.stats(name)
+			vs.Exposures, vs.Rewards = arm.Exposures, arm.Rewards
+		}
+		status.Versions = append(status.Versions, vs)
+	}
+	return status
+}
+
+// Status returns the current state of all experiments
+func (revaboxy *Revaboxy) Status() []Status {
+	now := time.Now()
+	statuses := make([]Status, 0, len(revaboxy.experiments))
+	for _, e := range revaboxy.experiments {
+		statuses = append(statuses, e.status(now))
+	}
+	return statuses
+}
+
+// StatusHandler serves the current state of all experiments as JSON
+func (revaboxy *Revaboxy) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(revaboxy.Status())
+	})
+}
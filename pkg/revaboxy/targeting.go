@@ -0,0 +1,443 @@
+package revaboxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Targeting decides which requests are eligible to be assigned a version of an experiment
+// Requests that are not eligible are sent to the default version without setting a cookie
+//
+// Targeting is created from an expression of matchers combined with && (and), || (or), ! (not) and parentheses, e.g.
+//
+//	language("sv") && (mobile() || query("beta", "1")) && !ip("10.0.0.0/8")
+//
+// The available matchers are:
+//
+//	header(name), header(name, value)  the header is set, or set to the value
+//	header_matches(name, regexp)       the header matches the regular expression
+//	language(tag, ...)                 the most preferred language in Accept-Language is any of the tags, "sv" matches "sv-SE"
+//	mobile()                           the User-Agent is a mobile device
+//	user_agent(regexp)                 the User-Agent matches the regular expression
+//	query(name), query(name, value)    the query parameter is set, or set to the value
+//	cookie(name), cookie(name, value)  the cookie is set, or set to the value
+//	ip(cidr, ...)                      the client ip is within any of the ranges, like "10.0.0.0/8" or "192.168.1.10"
+type Targeting struct {
+	expr  string
+	match func(req *http.Request) bool
+}
+
+// ParseTargeting parses a targeting expression
+// All regular expressions and ip ranges are parsed once, so that the targeting can be evaluated quickly on every request
+func ParseTargeting(expr string) (*Targeting, error) {
+	p := &targetingParser{expr: expr}
+	match, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid targeting %q: %s", expr, err)
+	}
+	return &Targeting{expr: expr, match: match}, nil
+}
+
+// MustParseTargeting is like ParseTargeting but panics if the expression is invalid
+func MustParseTargeting(expr string) *Targeting {
+	t, err := ParseTargeting(expr)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the expression the targeting was parsed from
+func (t *Targeting) String() string {
+	return t.expr
+}
+
+// WithTargeting limits the main experiment to requests that matches the targeting
+func WithTargeting(t *Targeting) Setting {
+	return func(s *settings) {
+		s.targeting = t
+	}
+}
+
+type matcher func(req *http.Request) bool
+
+// targetingParser is a recursive descent parser of targeting expressions
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | name "(" [ string { "," string } ] ")"
+type targetingParser struct {
+	expr string
+	pos  int
+}
+
+func (p *targetingParser) parse() (matcher, error) {
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.expr) {
+		return nil, p.errorf("unexpected %q", p.expr[p.pos:])
+	}
+	return m, nil
+}
+
+func (p *targetingParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *targetingParser) skipSpace() {
+	for p.pos < len(p.expr) && unicode.IsSpace(rune(p.expr[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume skips the token if it is next in the expression
+func (p *targetingParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.expr[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *targetingParser) or() (matcher, error) {
+	m, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("||") {
+		left := m
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		m = func(req *http.Request) bool {
+			return left(req) || right(req)
+		}
+	}
+	return m, nil
+}
+
+func (p *targetingParser) and() (matcher, error) {
+	m, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("&&") {
+		left := m
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		m = func(req *http.Request) bool {
+			return left(req) && right(req)
+		}
+	}
+	return m, nil
+}
+
+func (p *targetingParser) unary() (matcher, error) {
+	if p.consume("!") {
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			return !m(req)
+		}, nil
+	}
+
+	if p.consume("(") {
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("expected )")
+		}
+		return m, nil
+	}
+
+	return p.matcher()
+}
+
+func (p *targetingParser) matcher() (matcher, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.expr) && (p.expr[p.pos] == '_' || unicode.IsLetter(rune(p.expr[p.pos]))) {
+		p.pos++
+	}
+	name := p.expr[start:p.pos]
+	if name == "" {
+		if p.pos >= len(p.expr) {
+			return nil, p.errorf("unexpected end of expression")
+		}
+		return nil, p.errorf("expected a matcher, got %q", p.expr[p.pos:])
+	}
+
+	if !p.consume("(") {
+		return nil, p.errorf("expected ( after %s", name)
+	}
+	var args []string
+	if !p.consume(")") {
+		for {
+			arg, err := p.string()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.consume(")") {
+				break
+			}
+			if !p.consume(",") {
+				return nil, p.errorf("expected , or )")
+			}
+		}
+	}
+
+	newMatcher, ok := matchers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown matcher %s", name)
+	}
+	m, err := newMatcher(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return m, nil
+}
+
+// string parses a double quoted string, with the same escaping as in Go
+func (p *targetingParser) string() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.expr) || p.expr[p.pos] != '"' {
+		return "", p.errorf("expected a quoted string")
+	}
+	for end := p.pos + 1; end < len(p.expr); end++ {
+		if p.expr[end] == '\\' {
+			end++
+			continue
+		}
+		if p.expr[end] == '"' {
+			s, err := strconv.Unquote(p.expr[p.pos : end+1])
+			if err != nil {
+				return "", p.errorf("invalid string %s", p.expr[p.pos:end+1])
+			}
+			p.pos = end + 1
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+var matchers = map[string]func(args []string) (matcher, error){
+	"header": func(args []string) (matcher, error) {
+		if err := argCount(args, 1, 2); err != nil {
+			return nil, err
+		}
+		name := args[0]
+		if len(args) == 1 {
+			return func(req *http.Request) bool {
+				return len(req.Header.Values(name)) > 0
+			}, nil
+		}
+		value := args[1]
+		return func(req *http.Request) bool {
+			return req.Header.Get(name) == value
+		}, nil
+	},
+	"header_matches": func(args []string) (matcher, error) {
+		if err := argCount(args, 2, 2); err != nil {
+			return nil, err
+		}
+		name := args[0]
+		re, err := regexp.Compile(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			return re.MatchString(req.Header.Get(name))
+		}, nil
+	},
+	"language": func(args []string) (matcher, error) {
+		if err := argCount(args, 1, -1); err != nil {
+			return nil, err
+		}
+		tags := make([]string, 0, len(args))
+		for _, tag := range args {
+			tags = append(tags, strings.ToLower(tag))
+		}
+		return func(req *http.Request) bool {
+			lang := preferredLanguage(req.Header.Get("Accept-Language"))
+			for _, tag := range tags {
+				if lang == tag || strings.HasPrefix(lang, tag+"-") {
+					return true
+				}
+			}
+			return false
+		}, nil
+	},
+	"mobile": func(args []string) (matcher, error) {
+		if err := argCount(args, 0, 0); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			return mobileRegexp.MatchString(req.UserAgent())
+		}, nil
+	},
+	"user_agent": func(args []string) (matcher, error) {
+		if err := argCount(args, 1, 1); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			return re.MatchString(req.UserAgent())
+		}, nil
+	},
+	"query": func(args []string) (matcher, error) {
+		if err := argCount(args, 1, 2); err != nil {
+			return nil, err
+		}
+		name := args[0]
+		if len(args) == 1 {
+			return func(req *http.Request) bool {
+				_, ok := req.URL.Query()[name]
+				return ok
+			}, nil
+		}
+		value := args[1]
+		return func(req *http.Request) bool {
+			return req.URL.Query().Get(name) == value
+		}, nil
+	},
+	"cookie": func(args []string) (matcher, error) {
+		if err := argCount(args, 1, 2); err != nil {
+			return nil, err
+		}
+		name := args[0]
+		return func(req *http.Request) bool {
+			cookie, err := req.Cookie(name)
+			if err != nil {
+				return false
+			}
+			return len(args) == 1 || cookie.Value == args[1]
+		}, nil
+	},
+	"ip": func(args []string) (matcher, error) {
+		if err := argCount(args, 1, -1); err != nil {
+			return nil, err
+		}
+		nets, err := parseIPNets(args)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			return containsIP(nets, clientIP(req))
+		}, nil
+	},
+}
+
+var mobileRegexp = regexp.MustCompile(`(?i)mobi|android|iphone|ipod|ipad|windows phone|blackberry|opera mini`)
+
+func argCount(args []string, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("wrong number of arguments (%d)", len(args))
+	}
+	return nil
+}
+
+// preferredLanguage returns the language tag with the highest quality in an Accept-Language header, in lower case
+func preferredLanguage(header string) string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, language{tag: tag, quality: quality})
+		}
+	}
+	if len(languages) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	return languages[0].tag
+}
+
+// parseIPNets parses ip ranges in the CIDR notation, single ips are also allowed
+func parseIPNets(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip \"%s\"", r)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip range \"%s\"", r)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the ip of the client that connected to revaboxy
+// Headers like X-Forwarded-For are not used since they can be set by the client
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,141 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTargeting(t *testing.T) {
+	swedishMobile := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/?beta=1&empty=", nil)
+		req.Header.Set("Accept-Language", "en;q=0.8, sv-SE, *;q=0.1")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 13_5 like Mac OS X) Mobile/15E148")
+		req.Header.Set("X-Plan", "premium")
+		req.AddCookie(&http.Cookie{Name: "beta", Value: "yes"})
+		req.RemoteAddr = "10.1.2.3:5678"
+		return req
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: `language("sv")`, want: true},
+		{expr: `language("en", "de")`, want: false},
+		{expr: `language("sv-se")`, want: true},
+		{expr: `mobile()`, want: true},
+		{expr: `user_agent("Android")`, want: false},
+		{expr: `query("beta", "1")`, want: true},
+		{expr: `query("empty")`, want: true},
+		{expr: `query("missing")`, want: false},
+		{expr: `cookie("beta")`, want: true},
+		{expr: `cookie("beta", "no")`, want: false},
+		{expr: `header("X-Plan", "premium")`, want: true},
+		{expr: `header_matches("X-Plan", "^(free|basic)$")`, want: false},
+		{expr: `ip("10.0.0.0/8")`, want: true},
+		{expr: `ip("192.168.0.0/16", "10.1.2.3")`, want: true},
+		{expr: `!ip("10.0.0.0/8")`, want: false},
+		{expr: `language("sv") && mobile()`, want: true},
+		{expr: `language("sv") && !mobile()`, want: false},
+		{expr: `language("en") || mobile()`, want: true},
+		{expr: `language("en") || language("de") && mobile()`, want: false},
+		{expr: `(language("en") || language("sv")) && mobile()`, want: true},
+		{expr: `!(language("en") || query("missing"))`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			targeting, err := ParseTargeting(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if real := targeting.match(swedishMobile()); real != tt.want {
+				t.Errorf("match() = %v, want %v", real, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTargetingErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`mobile`,
+		`mobile() &&`,
+		`(mobile()`,
+		`mobile())`,
+		`unknown()`,
+		`language()`,
+		`mobile("yes")`,
+		`language(sv)`,
+		`language("sv`,
+		`header("a" "b")`,
+		`user_agent("(")`,
+		`ip("10.0.0.0/33")`,
+		`ip("localhost")`,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := ParseTargeting(expr); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestWithTargeting(t *testing.T) {
+	rt := &savingRoundtripper{}
+	proxy, err := New(
+		[]Version{
+			{
+				Name:        DefaultName,
+				URL:         mustURLParse("http://default.test"),
+				Probability: 0,
+			},
+			{
+				Name:        "green",
+				URL:         mustURLParse("http://green.test"),
+				Probability: 1,
+			},
+		},
+		WithTransport(rt),
+		WithTargeting(MustParseTargeting(`language("sv")`)),
+	)
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	// Requests that are not targeted should get the default version without a cookie
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Language", "en-US")
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "default.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real := len(rec.Result().Cookies()); real != 0 {
+		t.Fatalf("expected no cookies, got %d", real)
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Language", "sv")
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "green.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real := len(rec.Result().Cookies()); real != 1 {
+		t.Fatalf("expected one cookie, got %d", real)
+	}
+}
+
+func BenchmarkTargeting(b *testing.B) {
+	targeting := MustParseTargeting(`language("sv", "no", "da") && (mobile() || query("beta", "1")) && !ip("10.0.0.0/8")`)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/?beta=1", nil)
+	req.Header.Set("Accept-Language", "sv-SE,sv;q=0.9,en;q=0.8")
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	for i := 0; i < b.N; i++ {
+		targeting.match(req)
+	}
+}
@@ -3,21 +3,81 @@ package revaboxy
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
+	"sort"
+	"time"
 )
 
 type versions map[string]*Version
 
+// newVersions adds all versions and validates them
+func newVersions(vv []Version) (versions, error) {
+	versions := versions{}
+	for _, v := range vv {
+		err := versions.add(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := versions.valid(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
 func (vv versions) valid() error {
 	if _, ok := vv[DefaultName]; !ok {
 		return fmt.Errorf("a version with the name %s needs to exist", DefaultName)
 	}
 
-	totalProbability := 0.0
+	minShares, maxShares := 0.0, 0.0
 	for _, v := range vv {
-		totalProbability += v.Probability
+		if v.Handler != nil && (v.URL != nil || len(v.URLs) > 0) {
+			return fmt.Errorf("%s: can not have both a Handler and URLs", v.Name)
+		}
+		if v.MinShare < 0 || v.MinShare > 1 || v.MaxShare < 0 || v.MaxShare > 1 {
+			return fmt.Errorf("%s: the min and max share needs to be between 0 and 1", v.Name)
+		}
+		if v.MinShare > v.maxShare() {
+			return fmt.Errorf("%s: the min share is more than the max share", v.Name)
+		}
+		minShares += v.MinShare
+		maxShares += v.maxShare()
+
+		if v.Schedule == nil {
+			continue
+		}
+		if err := v.Schedule.validate(); err != nil {
+			return fmt.Errorf("%s: %s", v.Name, err)
+		}
+	}
+	if minShares > 1 {
+		return fmt.Errorf("the total min share is more than 1")
 	}
-	if totalProbability > 1 {
-		return fmt.Errorf("total percentage is more than 1")
+	if maxShares < 1 {
+		return fmt.Errorf("the total max share is less than 1")
+	}
+
+	// The total probability changes linearly between the steps of the schedules, so it is enough to check it at the steps
+	times := []time.Time{{}}
+	for _, v := range vv {
+		if v.Schedule != nil {
+			for _, step := range v.Schedule.Steps {
+				times = append(times, step.At)
+			}
+		}
+	}
+	for _, t := range times {
+		totalProbability := 0.0
+		for _, v := range vv {
+			totalProbability += v.probabilityAt(t)
+		}
+		if totalProbability > 1 {
+			if t.IsZero() {
+				return fmt.Errorf("total percentage is more than 1")
+			}
+			return fmt.Errorf("total percentage is more than 1 at %s", t.Format(time.RFC3339))
+		}
 	}
 
 	return nil
@@ -27,6 +87,7 @@ func (vv versions) add(v Version) error {
 	if _, ok := vv[v.Name]; ok {
 		return fmt.Errorf("dublicate name \"%s\"", v.Name)
 	}
+	v.balancer = newBalancer(&v)
 	vv[v.Name] = &v
 
 	return nil
@@ -38,15 +99,67 @@ func (vv versions) get(name string) *Version {
 }
 
 func (vv versions) getRandomVersion() *Version {
-	n := rand.Float64()
+	return vv.getVersion(rand.Float64())
+}
 
+// getVersion maps n, a number in the range [0,1), onto the current versions probabilities
+// The versions are always walked in the same order, so the same n will always result in the same version
+func (vv versions) getVersion(n float64) *Version {
+	now := time.Now()
 	addedProbability := 0.0
-	for _, v := range vv {
-		if n > addedProbability && n < addedProbability+v.Probability {
+	for _, name := range vv.names() {
+		v := vv[name]
+		p := v.probabilityAt(now)
+		if n >= addedProbability && n < addedProbability+p {
 			return v
 		}
-		addedProbability += v.Probability
+		addedProbability += p
 	}
 
 	return vv[DefaultName]
 }
+
+// shares returns the probability of a new user getting each version at the time t
+// The default version gets the rest of the probability
+func (vv versions) shares(t time.Time) map[string]float64 {
+	shares := map[string]float64{}
+	rest := 1.0
+	for name, v := range vv {
+		shares[name] = v.probabilityAt(t)
+		rest -= shares[name]
+	}
+	if rest > 0 {
+		shares[DefaultName] += rest
+	}
+	return shares
+}
+
+// pinned returns the version that the request is pinned to by an allowlist, or nil if it is not pinned
+// If several allowlists matches, the first version in name order is used
+func (vv versions) pinned(req *http.Request) *Version {
+	var claims map[string]interface{}
+	for _, name := range vv.names() {
+		v := vv[name]
+		if v.Allowlist == nil {
+			continue
+		}
+		// The token is only parsed if it is needed
+		if claims == nil && v.Allowlist.Claim != "" {
+			claims = bearerClaims(req)
+		}
+		if v.Allowlist.matches(req, claims) {
+			return v
+		}
+	}
+	return nil
+}
+
+// names returns the names of all versions, sorted
+func (vv versions) names() []string {
+	names := make([]string, 0, len(vv))
+	for name := range vv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,37 @@
+package revaboxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// WithVisitorSalt sets the salt that is hashed together with the identifiers of the users in the event log and the assignment store,
+// so that the hashes can not be reversed by hashing known identifiers
+func WithVisitorSalt(salt string) Setting {
+	return func(s *settings) {
+		s.visitorSalt = salt
+	}
+}
+
+// visitor returns the hashed identifier of the user making the request
+func (s *settings) visitor(req *http.Request) string {
+	return hashVisitor(s.visitorSalt, s.visitorIdentifier(req))
+}
+
+// visitorIdentifier returns an identifier of the user making the request, the bucketing key if it is available
+// and the ip and User-Agent otherwise
+func (s *settings) visitorIdentifier(req *http.Request) string {
+	if s.bucketingKey != nil {
+		if id := s.bucketingKey.identifier(req); id != "" {
+			return id
+		}
+	}
+	return clientIP(req).String() + "\x00" + req.UserAgent()
+}
+
+// hashVisitor hashes the salt and identifier of a user into a hex string
+func hashVisitor(salt, id string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + id))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,113 @@
+package revaboxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Window is the time an experiment is running
+// Before the start, everyone gets the default version. After the end, everyone gets the winner,
+// and cookies with other versions are rewritten to the winner
+type Window struct {
+	// The time the experiment starts, it is started from the beginning if not set
+	Start time.Time `json:"start"`
+	// The time the experiment ends, it never ends if not set
+	End time.Time `json:"end"`
+	// The version everyone gets after the end, defaults to DefaultName
+	Winner string `json:"winner,omitempty"`
+}
+
+// WithWindow sets the time the main experiment is running
+func WithWindow(w Window) Setting {
+	return func(s *settings) {
+		s.window = &w
+	}
+}
+
+func (w *Window) validate() error {
+	if !w.Start.IsZero() && !w.End.IsZero() && !w.End.After(w.Start) {
+		return fmt.Errorf("the end of the experiment needs to be after the start")
+	}
+	return nil
+}
+
+// winner returns the name of the version used after the end
+func (w *Window) winner() string {
+	if w.Winner == "" {
+		return DefaultName
+	}
+	return w.Winner
+}
+
+// phase is the part of the window an experiment is in
+type phase int32
+
+const (
+	phaseScheduled phase = iota
+	phaseRunning
+	phaseEnded
+)
+
+func (p phase) String() string {
+	switch p {
+	case phaseScheduled:
+		return "scheduled"
+	case phaseEnded:
+		return "ended"
+	}
+	return "running"
+}
+
+// phaseAt returns the phase at the time t
+func (w *Window) phaseAt(t time.Time) phase {
+	switch {
+	case w == nil:
+		return phaseRunning
+	case !w.Start.IsZero() && t.Before(w.Start):
+		return phaseScheduled
+	case !w.End.IsZero() && !t.Before(w.End):
+		return phaseEnded
+	}
+	return phaseRunning
+}
+
+// currentPhase returns the current phase of the experiment, and logs and counts the transition if the phase has changed
+func (e *experiment) currentPhase(s *settings) phase {
+	p := e.window.phaseAt(time.Now())
+	previous := phase(atomic.SwapInt32(&e.phase, int32(p)))
+	if previous != p {
+		switch p {
+		case phaseRunning:
+			e.logf(s, "the experiment has started")
+		case phaseEnded:
+			e.logf(s, "the experiment has ended, using the winner %s", e.window.winner())
+		}
+		labels := map[string]string{LabelPhase: p.String()}
+		if e.name != "" {
+			labels[LabelExperiment] = e.name
+		}
+		s.metrics.IncCounter(MetricPhaseTransitions, labels)
+	}
+	return p
+}
+
+// conclude uses the winner of an ended experiment
+// Users that have a cookie with another version gets it rewritten to the winner
+func (e *experiment) conclude(s *settings, req *http.Request) *assignment {
+	versions := e.getVersions()
+	a := &assignment{
+		experiment: e,
+		versions:   versions,
+		version:    versions[e.window.winner()],
+		kind:       AssignmentConcluded,
+	}
+	if cookie, _ := req.Cookie(e.cookieName); cookie != nil {
+		if name, ok := s.decodeCookieValue(cookie.Value); !ok || name != a.version.Name {
+			e.logf(s, "rewriting the cookie %s to the winner %s", cookie.Value, a.version.Name)
+			a.setCookie = true
+		}
+	}
+	return a
+}
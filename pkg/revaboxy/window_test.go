@@ -0,0 +1,123 @@
+package revaboxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWindowNotStarted(t *testing.T) {
+	rt := &savingRoundtripper{}
+	versions := append(testVersions(), Version{
+		Name: "blue",
+		URL:  mustURLParse("http://blue.test"),
+	})
+	versions[1].Probability, versions[2].Probability = 0.5, 0.5
+	proxy, err := New(versions, WithTransport(rt), WithMetrics(newTestMetrics()), WithWindow(Window{Start: time.Now().Add(time.Hour)}))
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "default.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	if real := len(rec.Result().Cookies()); real != 0 {
+		t.Fatalf("expected no cookies, got %d", real)
+	}
+	if real, expected := proxy.Status()[0].Phase, "scheduled"; real != expected {
+		t.Fatalf("expected the phase %s, got %s", expected, real)
+	}
+}
+
+func TestWindowEnded(t *testing.T) {
+	rt := &savingRoundtripper{}
+	m := newTestMetrics()
+	versions := append(testVersions(), Version{
+		Name: "blue",
+		URL:  mustURLParse("http://blue.test"),
+	})
+	versions[1].Probability, versions[2].Probability = 0.5, 0.5
+	proxy, err := New(versions, WithTransport(rt), WithMetrics(m), WithWindow(Window{End: time.Now().Add(time.Hour), Winner: "green"}))
+	if err != nil {
+		t.Fatal("could not create proxy", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: "blue"})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "blue.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s before the end, got %s", expected, real)
+	}
+
+	// End the experiment
+	proxy.experiments[0].window.End = time.Now()
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "revaboxy-name", Value: "blue"})
+	proxy.ServeHTTP(rec, req)
+
+	if real, expected := rt.req.URL.Host, "green.test"; real != expected {
+		t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "green" {
+		t.Fatalf("expected the cookie to be rewritten to green, got %v", cookies)
+	}
+	if real, expected := m.counters[`revaboxy_phase_transitions_total{phase="ended"}`], 1; real != expected {
+		t.Errorf("expected %d transitions, got %d", expected, real)
+	}
+
+	// Users with the winner, or without a cookie, should not get a new cookie
+	for _, cookie := range []*http.Cookie{{Name: "revaboxy-name", Value: "green"}, nil} {
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		proxy.ServeHTTP(rec, req)
+
+		if real, expected := rt.req.URL.Host, "green.test"; real != expected {
+			t.Fatalf("expected the request to be sent to %s, got %s", expected, real)
+		}
+		if real := len(rec.Result().Cookies()); real != 0 {
+			t.Fatalf("expected no cookies, got %d", real)
+		}
+	}
+
+	status := proxy.Status()[0]
+	if status.Phase != "ended" || status.Versions[2].Name != "green" || status.Versions[2].Probability != 1 {
+		t.Errorf("expected the ended phase with all traffic to green, got %+v", status)
+	}
+}
+
+func TestInvalidWindow(t *testing.T) {
+	now := time.Now()
+	for name, w := range map[string]Window{
+		"end before start": {Start: now, End: now.Add(-time.Hour)},
+		"unknown winner":   {End: now, Winner: "purple"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(
+				[]Version{
+					{
+						Name:        DefaultName,
+						URL:         mustURLParse("http://default.test"),
+						Probability: 1,
+					},
+				},
+				WithWindow(w),
+			)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}